@@ -0,0 +1,186 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// ErrUnknownAPIKey is returned for API keys which are not in the store.
+var ErrUnknownAPIKey = errors.New("unknown api key")
+
+// APIKey is the identity behind an API key. The key itself is never stored,
+// only its Hash as returned by HashAPIKey.
+type APIKey struct {
+	Id         string   `json:"id"`
+	Hash       string   `json:"hash"`
+	UserId     string   `json:"user_id"`
+	ClientId   string   `json:"client_id,omitempty"`
+	RealmRoles []string `json:"realm_roles,omitempty"`
+}
+
+// APIKeyStore looks up API keys by their hash.
+// Implementations must be safe for concurrent use.
+type APIKeyStore interface {
+	// Lookup returns the key with the given hash or ok == false.
+	Lookup(hash string) (key APIKey, ok bool, err error)
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash of an API key.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyAuth authenticates requests by an API key header.
+type APIKeyAuth struct {
+	// Header carrying the key. Defaults to "X-API-Key".
+	Header string
+	Store  APIKeyStore
+}
+
+// Method implements the Authenticator interface.
+func (a *APIKeyAuth) Method() string {
+	return AuthMethodAPIKey
+}
+
+func (a *APIKeyAuth) header() string {
+	if a.Header == "" {
+		return "X-API-Key"
+	}
+	return a.Header
+}
+
+// Authenticate implements the Authenticator interface. It returns
+// ok == false if the request has no API key header.
+func (a *APIKeyAuth) Authenticate(r *http.Request) (token Jwt, ok bool, err error) {
+	plain := r.Header.Get(a.header())
+	if plain == "" {
+		return token, false, nil
+	}
+	key, found, err := a.Store.Lookup(HashAPIKey(plain))
+	if err != nil {
+		return token, true, err
+	}
+	if !found {
+		return token, true, ErrUnknownAPIKey
+	}
+	return key.identity(), true, nil
+}
+
+func (key APIKey) identity() (token Jwt) {
+	token.UserId = key.UserId
+	token.RealmAccess = Resource{Roles: key.RealmRoles}
+	token.Map = map[string]interface{}{
+		"sub":          key.UserId,
+		"azp":          key.ClientId,
+		"api_key_id":   key.Id,
+		"realm_access": map[string]interface{}{"roles": key.RealmRoles},
+	}
+	return
+}
+
+// MemoryAPIKeyStore is an APIKeyStore held in memory.
+type MemoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+// NewMemoryAPIKeyStore returns a store with the given keys, which must have
+// their Hash set.
+func NewMemoryAPIKeyStore(keys ...APIKey) *MemoryAPIKeyStore {
+	s := &MemoryAPIKeyStore{keys: map[string]APIKey{}}
+	for _, key := range keys {
+		s.keys[key.Hash] = key
+	}
+	return s
+}
+
+// Add hashes plain and stores key under the hash. plain is not kept.
+func (s *MemoryAPIKeyStore) Add(plain string, key APIKey) {
+	key.Hash = HashAPIKey(plain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key.Hash] = key
+}
+
+// Remove deletes the key with the given id.
+func (s *MemoryAPIKeyStore) Remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, key := range s.keys {
+		if key.Id == id {
+			delete(s.keys, hash)
+		}
+	}
+}
+
+// Lookup implements the APIKeyStore interface.
+func (s *MemoryAPIKeyStore) Lookup(hash string) (APIKey, bool, error) {
+	s.mu.RLock()
+	key, ok := s.keys[hash]
+	s.mu.RUnlock()
+	// compare again in constant time, the map lookup only selects the candidate
+	if !ok || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash)) != 1 {
+		return APIKey{}, false, nil
+	}
+	return key, true, nil
+}
+
+// FileAPIKeyStore is an APIKeyStore read from a JSON file holding an array of
+// APIKey objects.
+type FileAPIKeyStore struct {
+	path string
+	*MemoryAPIKeyStore
+}
+
+// NewFileAPIKeyStore loads the keys from path.
+func NewFileAPIKeyStore(path string) (*FileAPIKeyStore, error) {
+	s := &FileAPIKeyStore{path: path, MemoryAPIKeyStore: NewMemoryAPIKeyStore()}
+	return s, s.Reload()
+}
+
+// Reload reads the file again and replaces all keys. On error the previous
+// keys are kept.
+func (s *FileAPIKeyStore) Reload() error {
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	list := []APIKey{}
+	if err = json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	keys := map[string]APIKey{}
+	for _, key := range list {
+		if len(key.Hash) != sha256.Size*2 {
+			return errors.New("invalid hash for api key " + key.Id)
+		}
+		keys[key.Hash] = key
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	return nil
+}
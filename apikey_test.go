@@ -0,0 +1,97 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	store := NewMemoryAPIKeyStore()
+	store.Add("s3cr3t", APIKey{Id: "partner-1", UserId: "partner", ClientId: "billing", RealmRoles: []string{"partner"}})
+
+	router := New(JwtConfig{ForceAuth: true})
+	router.APIKeys = &APIKeyAuth{Header: "X-Partner-Key", Store: store}
+	var got Jwt
+	router.GET("/me", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {
+		got = jwt
+	})
+	serve := func(key string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/me", nil)
+		if key != "" {
+			req.Header.Set("X-Partner-Key", key)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := serve("s3cr3t"); code != http.StatusOK {
+		t.Fatalf("valid key rejected: %d", code)
+	}
+	if got.UserId != "partner" || got.Map["azp"] != "billing" || got.Map["api_key_id"] != "partner-1" {
+		t.Errorf("wrong identity: %+v", got)
+	}
+	if !reflect.DeepEqual(got.RealmAccess.Roles, []string{"partner"}) {
+		t.Errorf("wrong roles: %v", got.RealmAccess.Roles)
+	}
+	if code := serve("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("unknown key accepted: %d", code)
+	}
+	if code := serve(""); code != http.StatusUnauthorized {
+		t.Errorf("request without key accepted: %d", code)
+	}
+
+	store.Remove("partner-1")
+	if code := serve("s3cr3t"); code != http.StatusUnauthorized {
+		t.Errorf("removed key accepted: %d", code)
+	}
+}
+
+func TestFileAPIKeyStore(t *testing.T) {
+	f, err := ioutil.TempFile("", "apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"id": "k1", "hash": "` + HashAPIKey("s3cr3t") + `", "user_id": "partner"}]`)
+	f.Close()
+
+	store, err := NewFileAPIKeyStore(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, ok, _ := store.Lookup(HashAPIKey("s3cr3t")); !ok || key.UserId != "partner" {
+		t.Errorf("key not found: %+v", key)
+	}
+	if _, ok, _ := store.Lookup("s3cr3t"); ok {
+		t.Error("lookup by plain key succeeded")
+	}
+
+	ioutil.WriteFile(f.Name(), []byte(`[{"id": "k1", "hash": "s3cr3t"}]`), 0600)
+	if err := store.Reload(); err == nil {
+		t.Error("file with plain key accepted")
+	}
+	if _, ok, _ := store.Lookup(HashAPIKey("s3cr3t")); !ok {
+		t.Error("keys lost after failed reload")
+	}
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Outcomes of an AuditEvent.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// Reason codes of an AuditEvent.
+const (
+	AuditReasonAuthenticated       = "authenticated"
+	AuditReasonAnonymous           = "anonymous"
+	AuditReasonMissingCredentials  = "missing_credentials"
+	AuditReasonInvalidCredentials  = "invalid_credentials"
+	AuditReasonMissingUserId       = "missing_user_id"
+	AuditReasonMethodNotAccepted   = "auth_method_not_accepted"
+	AuditReasonInsufficientRoles   = "insufficient_roles"
+	AuditReasonDPoPRequired        = "dpop_required"
+	AuditReasonInvalidDPoPProof    = "invalid_dpop_proof"
+	AuditReasonCertificateBinding  = "certificate_binding"
+	AuditReasonImpersonationDenied = "impersonation_denied"
+	AuditReasonProviderUnavailable = "provider_unavailable"
+)
+
+// AuditEvent records one authentication decision of the router. Impersonated
+// is the user id an authenticated caller acts as on behalf of Actor, or asked
+// to act as if impersonation was denied.
+type AuditEvent struct {
+	Time         time.Time `json:"time"`
+	Outcome      string    `json:"outcome"`
+	Reason       string    `json:"reason"`
+	UserId       string    `json:"sub,omitempty"`
+	ClientId     string    `json:"azp,omitempty"`
+	Actor        string    `json:"act,omitempty"`
+	Impersonated string    `json:"impersonated,omitempty"`
+	AuthMethod   string    `json:"auth_method,omitempty"`
+	Method       string    `json:"method"`
+	Route        string    `json:"route"`
+	RemoteAddr   string    `json:"remote_addr"`
+}
+
+// AuditSink receives the audit events of a router. Implementations must be
+// safe for concurrent use and should not block the request for long.
+type AuditSink interface {
+	Audit(event AuditEvent)
+}
+
+// audit sends the authentication decision for req to r.Audit, if it is set.
+func (r *Router) audit(req *http.Request, route *Route, token Jwt, err error) {
+	if r.Audit == nil {
+		return
+	}
+	event := newAuditEvent(req, route, token, err)
+	if err == ErrImpersonationDenied {
+		// the bearer authenticator verified the token before it checked the
+		// header, so the requested subject is worth recording
+		event.Impersonated = req.Header.Get(r.JwtConf.ImpersonationHeader)
+	}
+	r.Audit.Audit(event)
+}
+
+// newAuditEvent describes the authentication of req for the route.
+func newAuditEvent(req *http.Request, route *Route, token Jwt, err error) AuditEvent {
+	event := AuditEvent{
+		Time:       time.Now().UTC(),
+		Outcome:    AuditSuccess,
+		Reason:     AuditReasonAuthenticated,
+		UserId:     token.UserId,
+		AuthMethod: token.AuthMethod,
+		Method:     req.Method,
+		RemoteAddr: req.RemoteAddr,
+	}
+	if route != nil {
+		event.Route = route.Path
+	}
+	if azp, ok := token.Map["azp"].(string); ok {
+		event.ClientId = azp
+	}
+	if token.Actor != nil {
+		event.Actor = token.Actor.UserId
+		event.Impersonated = token.UserId
+	}
+	if err != nil {
+		event.Outcome = AuditFailure
+		event.Reason = auditReason(err)
+	} else if event.UserId == "" && event.AuthMethod == "" {
+		event.Reason = AuditReasonAnonymous
+	}
+	return event
+}
+
+func auditReason(err error) string {
+	if ve, ok := err.(*jwt.ValidationError); ok && ve.Inner != nil {
+		// errors of the key source are wrapped by the token parser
+		err = ve.Inner
+	}
+	switch err {
+	case ErrMissingCredentials:
+		return AuditReasonMissingCredentials
+	case ErrMissingUserId:
+		return AuditReasonMissingUserId
+	case ErrAuthMethodNotAccepted:
+		return AuditReasonMethodNotAccepted
+	case ErrInsufficientRoles:
+		return AuditReasonInsufficientRoles
+	case ErrDPoPRequired:
+		return AuditReasonDPoPRequired
+	case ErrInvalidDPoPProof:
+		return AuditReasonInvalidDPoPProof
+	case ErrCertificateBindingMismatch, ErrCertificateBoundRequired:
+		return AuditReasonCertificateBinding
+	case ErrImpersonationDenied:
+		return AuditReasonImpersonationDenied
+	case ErrProviderUnavailable:
+		return AuditReasonProviderUnavailable
+	}
+	return AuditReasonInvalidCredentials
+}
+
+// JSONLinesAuditSink writes every event as one line of JSON.
+type JSONLinesAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLinesAuditSink returns a sink writing to w.
+func NewJSONLinesAuditSink(w io.Writer) *JSONLinesAuditSink {
+	return &JSONLinesAuditSink{w: w}
+}
+
+// OpenAuditFile returns a sink appending to the file at path, which is created
+// if necessary. Close closes the file.
+func OpenAuditFile(path string) (*JSONLinesAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLinesAuditSink(f), nil
+}
+
+// Audit implements the AuditSink interface.
+func (s *JSONLinesAuditSink) Audit(event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(append(line, '\n'))
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (s *JSONLinesAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// MemoryAuditSink keeps all events in memory, e.g. for tests.
+type MemoryAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+// Audit implements the AuditSink interface.
+func (s *MemoryAuditSink) Audit(event AuditEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+// Events returns a copy of the recorded events.
+func (s *MemoryAuditSink) Events() []AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]AuditEvent(nil), s.events...)
+}
+
+// Reset drops all recorded events.
+func (s *MemoryAuditSink) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = nil
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestAuditEvents(t *testing.T) {
+	key := newTestKey(t)
+	router := New(JwtConfig{
+		PubRsa:              string(publicKeyPEM(t, key)),
+		ImpersonationHeader: "X-Impersonate-User",
+		ImpersonationRoles:  []string{"support"},
+	})
+	sink := &MemoryAuditSink{}
+	router.Audit = sink
+	router.GET("/users/:id", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {})
+	router.GET("/keys", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {}, AuthMethods(AuthMethodAPIKey))
+
+	serve := func(path, auth, impersonate string) {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		if impersonate != "" {
+			req.Header.Set("X-Impersonate-User", impersonate)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	staff := signedAuth(t, key, jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub":          "staff",
+		"azp":          "console",
+		"realm_access": map[string]interface{}{"roles": []interface{}{"support"}},
+	})
+	alice := signedAuth(t, key, jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice"})
+
+	serve("/users/1", staff, "")
+	serve("/users/2", "", "")
+	serve("/users/3", "Bearer invalid.token.value", "")
+	serve("/keys", staff, "")
+	serve("/users/4", staff, "customer")
+	serve("/users/5", alice, "customer")
+	serve("/users/6", "", "customer")
+	serve("/users/7", "Bearer invalid.token.value", "customer")
+
+	want := []AuditEvent{
+		{Outcome: AuditSuccess, Reason: AuditReasonAuthenticated, UserId: "staff", ClientId: "console", AuthMethod: AuthMethodBearer},
+		{Outcome: AuditSuccess, Reason: AuditReasonAnonymous},
+		{Outcome: AuditFailure, Reason: AuditReasonInvalidCredentials, AuthMethod: AuthMethodBearer},
+		{Outcome: AuditFailure, Reason: AuditReasonMethodNotAccepted, UserId: "staff", ClientId: "console", AuthMethod: AuthMethodBearer},
+		{Outcome: AuditSuccess, Reason: AuditReasonAuthenticated, UserId: "customer", ClientId: "console", Actor: "staff", Impersonated: "customer", AuthMethod: AuthMethodBearer},
+		{Outcome: AuditFailure, Reason: AuditReasonImpersonationDenied, UserId: "alice", Impersonated: "customer", AuthMethod: AuthMethodBearer},
+		// the header alone is not recorded
+		{Outcome: AuditSuccess, Reason: AuditReasonAnonymous},
+		{Outcome: AuditFailure, Reason: AuditReasonInvalidCredentials, AuthMethod: AuthMethodBearer},
+	}
+	events := sink.Events()
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, event := range events {
+		if event.Time.IsZero() || event.Method != "GET" || event.RemoteAddr != "192.0.2.1:1234" {
+			t.Errorf("event %d: missing request data: %+v", i, event)
+		}
+		if want := map[bool]string{true: "/keys", false: "/users/:id"}[i == 3]; event.Route != want {
+			t.Errorf("event %d: got route %q, want %q", i, event.Route, want)
+		}
+		want[i].Time, want[i].Method, want[i].Route, want[i].RemoteAddr = event.Time, event.Method, event.Route, event.RemoteAddr
+		if event != want[i] {
+			t.Errorf("event %d:\ngot  %+v\nwant %+v", i, event, want[i])
+		}
+	}
+}
+
+func TestJSONLinesAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONLinesAuditSink(&buf)
+	sink.Audit(AuditEvent{Outcome: AuditSuccess, UserId: "alice", Route: "/me"})
+	sink.Audit(AuditEvent{Outcome: AuditFailure, Reason: AuditReasonMissingCredentials, Route: "/me"})
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %s", len(lines), buf.String())
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(lines[1], &event); err != nil {
+		t.Fatal(err)
+	}
+	if event["outcome"] != AuditFailure || event["reason"] != AuditReasonMissingCredentials || event["route"] != "/me" {
+		t.Errorf("wrong event: %s", lines[1])
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Authentication methods of the built-in authenticators, as recorded in
+// Jwt.AuthMethod.
+const (
+	AuthMethodBearer     = "bearer"
+	AuthMethodAPIKey     = "apikey"
+	AuthMethodClientCert = "mtls"
+	AuthMethodBasic      = "basic"
+)
+
+var (
+	// ErrMissingCredentials is returned if JwtConfig.ForceAuth is set and no
+	// authenticator recognized the credentials of a request.
+	ErrMissingCredentials = errors.New("missing credentials")
+
+	// ErrUnsupportedCredentials is returned if a request has an
+	// Authorization header no authenticator recognized.
+	ErrUnsupportedCredentials = errors.New("unsupported credentials")
+
+	// ErrMissingUserId is returned if JwtConfig.ForceUser is set and the
+	// authenticated identity has no user id.
+	ErrMissingUserId = errors.New("missing user id")
+
+	// ErrAuthMethodNotAccepted is returned if a route does not accept the
+	// authentication method of a request, see AuthMethods.
+	ErrAuthMethodNotAccepted = errors.New("authentication method not accepted")
+
+	// ErrInsufficientRoles is returned if the identity of a request lacks
+	// the roles or scopes required by a route, see RequireRoles and
+	// RequireScopes. The router answers it with 403 Forbidden.
+	ErrInsufficientRoles = errors.New("insufficient roles or scopes")
+)
+
+// Authenticator builds the identity of a request from one kind of
+// credentials. JwtConfig, APIKeyAuth, ClientCertAuth and BasicAuth are
+// Authenticators.
+type Authenticator interface {
+	// Method returns the name recorded in Jwt.AuthMethod.
+	Method() string
+
+	// Authenticate returns ok == false if the request carries no credentials
+	// of this kind. Otherwise err decides whether authentication succeeded.
+	Authenticate(r *http.Request) (token Jwt, ok bool, err error)
+}
+
+// jwt authenticates r with the first authenticator recognizing its
+// credentials. Without Router.Authenticators the chain is JwtConf, APIKeys
+// and ClientCert. An Authorization header no authenticator recognizes is
+// rejected, even if anonymous requests are allowed.
+func (router *Router) jwt(r *http.Request) (token Jwt, err error) {
+	var ok bool
+	if router.Authenticators != nil {
+		for _, a := range router.Authenticators {
+			if token, ok, err = a.Authenticate(r); ok {
+				token.AuthMethod = a.Method()
+				break
+			}
+		}
+	} else {
+		token, ok, err = router.JwtConf.Authenticate(r)
+		token.AuthMethod = AuthMethodBearer
+		if !ok && router.APIKeys != nil {
+			token, ok, err = router.APIKeys.Authenticate(r)
+			token.AuthMethod = AuthMethodAPIKey
+		}
+		if !ok && router.ClientCert != nil {
+			token, ok, err = router.ClientCert.Authenticate(r)
+			token.AuthMethod = AuthMethodClientCert
+		}
+	}
+
+	if !ok {
+		token = Jwt{Map: map[string]interface{}{}}
+		if r.Header.Get("Authorization") != "" {
+			// credentials the client meant to use must not be ignored
+			err = ErrUnsupportedCredentials
+		} else if router.JwtConf.ForceAuth {
+			err = ErrMissingCredentials
+		}
+		return
+	}
+	if err == nil && router.JwtConf.ForceUser && token.UserId == "" {
+		err = ErrMissingUserId
+	}
+	return
+}
+
+// AuthMethods limits a route to requests authenticated by one of the given
+// methods. Anonymous requests are rejected.
+func AuthMethods(methods ...string) RouteOption {
+	return func(route *Route) {
+		route.AuthMethods = methods
+	}
+}
+
+// RequireRoles limits a route to identities with at least one of the given
+// realm roles.
+func RequireRoles(roles ...string) RouteOption {
+	return func(route *Route) {
+		route.Roles = roles
+	}
+}
+
+// RequireScopes limits a route to tokens whose "scope" claim contains all of
+// the given scopes.
+func RequireScopes(scopes ...string) RouteOption {
+	return func(route *Route) {
+		route.Scopes = scopes
+	}
+}
+
+// authorize checks token against the authentication requirements of the route.
+func (route *Route) authorize(token Jwt) error {
+	if route == nil {
+		return nil
+	}
+	if len(route.AuthMethods) > 0 && !contains(route.AuthMethods, token.AuthMethod) {
+		return ErrAuthMethodNotAccepted
+	}
+	if route.DPoP && (token.AuthMethod != AuthMethodBearer || token.Confirmation == nil || token.Confirmation.JKT == "") {
+		return ErrDPoPRequired
+	}
+	if route.CertificateBound && (token.AuthMethod != AuthMethodBearer || token.Confirmation == nil || token.Confirmation.X5tS256 == "") {
+		return ErrCertificateBoundRequired
+	}
+	if (len(route.Roles) > 0 || len(route.Scopes) > 0) && token.AuthMethod == "" {
+		return ErrMissingCredentials
+	}
+	if len(route.Roles) > 0 && !token.hasAnyRealmRole(route.Roles) {
+		return ErrInsufficientRoles
+	}
+	if len(route.Scopes) > 0 {
+		scope, _ := token.Map["scope"].(string)
+		granted := strings.Fields(scope)
+		for _, s := range route.Scopes {
+			if !contains(granted, s) {
+				return ErrInsufficientRoles
+			}
+		}
+	}
+	return nil
+}
+
+// BasicAuth authenticates legacy clients by HTTP Basic authentication. The
+// username is the Id and the password the secret of an API key in Store.
+type BasicAuth struct {
+	Store APIKeyStore
+}
+
+// Method implements the Authenticator interface.
+func (b *BasicAuth) Method() string {
+	return AuthMethodBasic
+}
+
+// Authenticate implements the Authenticator interface. It returns
+// ok == false if the request has no Basic Authorization header.
+func (b *BasicAuth) Authenticate(r *http.Request) (token Jwt, ok bool, err error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return token, false, nil
+	}
+	key, found, err := b.Store.Lookup(HashAPIKey(password))
+	if err != nil {
+		return token, true, err
+	}
+	if !found || key.Id != username {
+		return token, true, errors.New("invalid username or password")
+	}
+	return key.identity(), true, nil
+}
+
+func isBasicAuth(auth string) bool {
+	return len(auth) >= 6 && strings.EqualFold(auth[:6], "basic ")
+}
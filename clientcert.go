@@ -0,0 +1,174 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrCertificateBindingMismatch is returned for certificate-bound tokens
+	// sent without the client certificate they are bound to (RFC 8705).
+	ErrCertificateBindingMismatch = errors.New("token not bound to client certificate")
+
+	// ErrCertificateBoundRequired is returned if a route requires a
+	// certificate-bound token but the request has none.
+	ErrCertificateBoundRequired = errors.New("certificate-bound token required")
+)
+
+// Certificate fields which can be used as UserId of a client certificate.
+const (
+	CertUserIdCommonName = "cn"
+	CertUserIdDNS        = "san-dns"
+	CertUserIdURI        = "san-uri"
+	CertUserIdEmail      = "san-email"
+)
+
+// ClientCertAuth authenticates requests by the TLS client certificate which
+// the server verified, e.g. with tls.Config.ClientAuth set to
+// tls.VerifyClientCertIfGiven. The resulting identity is a Jwt, so role checks
+// work the same way as for bearer tokens.
+type ClientCertAuth struct {
+	// UserIdFrom selects the certificate field used as UserId, one of the
+	// CertUserId constants. Defaults to the subject common name.
+	UserIdFrom string
+
+	// Roles maps certificate attributes to realm roles. Keys have the form
+	// "CN=<common name>", "OU=<organizational unit>", "O=<organization>",
+	// "DNS:<san>", "URI:<san>" or "email:<san>". The roles of all matching
+	// keys are combined.
+	Roles map[string][]string
+
+	// DefaultRoles are given to every authenticated certificate.
+	DefaultRoles []string
+}
+
+// Method implements the Authenticator interface.
+func (c *ClientCertAuth) Method() string {
+	return AuthMethodClientCert
+}
+
+// Authenticate implements the Authenticator interface. It returns
+// ok == false if the request has no client certificate.
+func (c *ClientCertAuth) Authenticate(r *http.Request) (token Jwt, ok bool, err error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return token, false, nil
+	}
+	if len(r.TLS.VerifiedChains) == 0 {
+		return token, true, errors.New("client certificate not verified")
+	}
+	cert := r.TLS.PeerCertificates[0]
+
+	token.UserId = c.userId(cert)
+	if token.UserId == "" {
+		return token, true, errors.New("client certificate without " + c.userIdFrom())
+	}
+	roles := append([]string{}, c.DefaultRoles...)
+	for _, attribute := range certAttributes(cert) {
+		for _, role := range c.Roles[attribute] {
+			if !contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	token.RealmAccess = Resource{Roles: roles}
+	token.Map = map[string]interface{}{
+		"sub":          token.UserId,
+		"realm_access": map[string]interface{}{"roles": roles},
+		"cert_subject": cert.Subject.String(),
+		"cert_issuer":  cert.Issuer.String(),
+		"cert_serial":  cert.SerialNumber.String(),
+	}
+	return token, true, nil
+}
+
+func (c *ClientCertAuth) userIdFrom() string {
+	if c.UserIdFrom == "" {
+		return CertUserIdCommonName
+	}
+	return c.UserIdFrom
+}
+
+func (c *ClientCertAuth) userId(cert *x509.Certificate) string {
+	switch c.userIdFrom() {
+	case CertUserIdCommonName:
+		return cert.Subject.CommonName
+	case CertUserIdDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case CertUserIdURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	case CertUserIdEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	}
+	return ""
+}
+
+// certAttributes lists the keys of cert which ClientCertAuth.Roles can match.
+func certAttributes(cert *x509.Certificate) (attributes []string) {
+	if cert.Subject.CommonName != "" {
+		attributes = append(attributes, "CN="+cert.Subject.CommonName)
+	}
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		attributes = append(attributes, "OU="+ou)
+	}
+	for _, o := range cert.Subject.Organization {
+		attributes = append(attributes, "O="+o)
+	}
+	for _, name := range cert.DNSNames {
+		attributes = append(attributes, "DNS:"+name)
+	}
+	for _, uri := range cert.URIs {
+		attributes = append(attributes, "URI:"+uri.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		attributes = append(attributes, "email:"+email)
+	}
+	return
+}
+
+// RequireCertificateBound makes a route accept only bearer tokens bound to the
+// TLS client certificate of the request (RFC 8705).
+func RequireCertificateBound() RouteOption {
+	return func(route *Route) {
+		route.CertificateBound = true
+	}
+}
+
+// verifyCertificateBinding compares the x5t#S256 confirmation of a token with
+// the thumbprint of the client certificate of r.
+func verifyCertificateBinding(r *http.Request, x5t string) error {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ErrCertificateBindingMismatch
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	thumbprint := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(thumbprint), []byte(x5t)) != 1 {
+		return ErrCertificateBindingMismatch
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func clientCertRequest(cert *x509.Certificate, verified bool) *http.Request {
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if verified {
+		req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	return req
+}
+
+func TestClientCertAuth(t *testing.T) {
+	router := New(JwtConfig{ForceAuth: true})
+	router.ClientCert = &ClientCertAuth{
+		UserIdFrom:   CertUserIdDNS,
+		DefaultRoles: []string{"device"},
+		Roles: map[string][]string{
+			"OU=gateways":         {"gateway"},
+			"DNS:meter-1.example": {"meter"},
+		},
+	}
+	var got Jwt
+	router.GET("/me", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {
+		got = jwt
+	})
+
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "meter-1", OrganizationalUnit: []string{"gateways"}},
+		DNSNames: []string{"meter-1.example"},
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, clientCertRequest(cert, true))
+	if w.Code != http.StatusOK {
+		t.Fatalf("verified certificate rejected: %d %s", w.Code, w.Body.String())
+	}
+	if got.UserId != "meter-1.example" {
+		t.Errorf("wrong user id: %q", got.UserId)
+	}
+	if want := []string{"device", "gateway", "meter"}; !reflect.DeepEqual(got.RealmAccess.Roles, want) {
+		t.Errorf("wrong roles: got %v, want %v", got.RealmAccess.Roles, want)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, clientCertRequest(cert, false))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unverified certificate accepted: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, clientCertRequest(&x509.Certificate{Subject: pkix.Name{CommonName: "no-san"}}, true))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("certificate without user id accepted: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("request without credentials accepted: %d", w.Code)
+	}
+}
+
+func TestCertificateBoundToken(t *testing.T) {
+	key := newTestKey(t)
+	router := New(JwtConfig{PubRsa: string(publicKeyPEM(t, key))})
+	router.GET("/me", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {})
+	router.GET("/bound", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {}, RequireCertificateBound())
+
+	cert := &x509.Certificate{Raw: []byte("client certificate"), Subject: pkix.Name{CommonName: "client"}}
+	other := &x509.Certificate{Raw: []byte("other certificate"), Subject: pkix.Name{CommonName: "other"}}
+	sum := sha256.Sum256(cert.Raw)
+	bound := signedAuth(t, key, jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "alice",
+		"cnf": map[string]interface{}{"x5t#S256": base64.RawURLEncoding.EncodeToString(sum[:])},
+	})
+	unbound := signedAuth(t, key, jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice"})
+
+	serve := func(path, auth string, cert *x509.Certificate) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		if cert != nil {
+			req = clientCertRequest(cert, true)
+			req.URL.Path = path
+		}
+		req.Header.Set("Authorization", auth)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		name string
+		path string
+		auth string
+		cert *x509.Certificate
+		code int
+	}{
+		{"bound token with its certificate", "/bound", bound, cert, http.StatusOK},
+		{"bound token with other certificate", "/me", bound, other, http.StatusUnauthorized},
+		{"bound token without certificate", "/me", bound, nil, http.StatusUnauthorized},
+		{"unbound token on bound route", "/bound", unbound, cert, http.StatusUnauthorized},
+		{"unbound token on other route", "/me", unbound, nil, http.StatusOK},
+	}
+	for _, test := range tests {
+		if code := serve(test.path, test.auth, test.cert); code != test.code {
+			t.Errorf("%s: got %d, want %d", test.name, code, test.code)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// A constraint restricts the values of a named parameter. It is written in
+// angle brackets after the parameter name:
+//  :id<uuid>         a UUID
+//  :n<int>           a decimal integer
+//  :code<[A-Z]{3}>   a regular expression matching the whole value
+// Requests with values violating the constraint do not match the route.
+type constraint struct {
+	match  func(value string) bool
+	schema Schema // the OpenAPI schema of the parameter
+}
+
+// Named constraints. Every other constraint is a regular expression.
+var namedConstraints = map[string]*constraint{
+	"int": {
+		match:  func(s string) bool { _, err := strconv.ParseInt(s, 10, 64); return err == nil },
+		schema: Schema{"type": "integer", "format": "int64"},
+	},
+	"uint": {
+		match:  func(s string) bool { _, err := strconv.ParseUint(s, 10, 64); return err == nil },
+		schema: Schema{"type": "integer", "minimum": 0},
+	},
+	"uuid": {
+		match:  isUUID,
+		schema: Schema{"type": "string", "format": "uuid"},
+	},
+	"alpha": {
+		match:  func(s string) bool { return s != "" && allBytes(s, isAlpha) },
+		schema: Schema{"type": "string", "pattern": "^[A-Za-z]+$"},
+	},
+	"alnum": {
+		match:  func(s string) bool { return s != "" && allBytes(s, isAlnum) },
+		schema: Schema{"type": "string", "pattern": "^[A-Za-z0-9]+$"},
+	},
+	"hex": {
+		match:  func(s string) bool { return s != "" && allBytes(s, isHex) },
+		schema: Schema{"type": "string", "pattern": "^[0-9A-Fa-f]+$"},
+	},
+}
+
+// compiled regular expression constraints by their pattern
+var regexpConstraints sync.Map
+
+// parseConstraint returns the constraint written as s, without the angle
+// brackets. It panics if s is not a valid regular expression.
+func parseConstraint(s string) *constraint {
+	if c, ok := namedConstraints[s]; ok {
+		return c
+	}
+	if c, ok := regexpConstraints.Load(s); ok {
+		return c.(*constraint)
+	}
+	anchored := "^(?:" + s + ")$"
+	re, err := regexp.Compile(anchored)
+	if err != nil {
+		panic("invalid constraint '<" + s + ">': " + err.Error())
+	}
+	c, _ := regexpConstraints.LoadOrStore(s, &constraint{
+		match:  re.MatchString,
+		schema: Schema{"type": "string", "pattern": anchored},
+	})
+	return c.(*constraint)
+}
+
+// wildcardEnd returns the end of the wildcard at the start of path. The name
+// of a named parameter consists of ASCII letters, digits and '_' if another
+// wildcard follows in its path segment. Otherwise it runs to the end of the
+// segment, like 'user-id' in '/users/:user-id'. The name may be followed by a
+// constraint, which may contain slashes and ends at the matching '>'. A
+// catch-all parameter ends at the path end.
+func wildcardEnd(path string) int {
+	if path[0] == '*' {
+		return len(path)
+	}
+	i := 1
+	for i < len(path) && (isAlnum(path[i]) || path[i] == '_') {
+		i++
+	}
+	if i < len(path) && path[i] != '<' && !wildcardFollows(path[i:]) {
+		for i < len(path) && path[i] != '/' && path[i] != '<' {
+			i++
+		}
+	}
+	if i == len(path) || path[i] != '<' {
+		return i
+	}
+	depth := 0
+	for j := i; j < len(path); j++ {
+		switch path[j] {
+		case '<':
+			depth++
+		case '>':
+			depth--
+		}
+		if depth == 0 {
+			return j + 1
+		}
+	}
+	panic("unterminated constraint in path '" + path + "'")
+}
+
+// wildcardFollows reports whether the path segment starting at path contains
+// a wildcard.
+func wildcardFollows(path string) bool {
+	for i := 0; i < len(path) && path[i] != '/'; i++ {
+		if path[i] == ':' || path[i] == '*' {
+			return true
+		}
+	}
+	return false
+}
+
+// splitWildcard splits a wildcard without its leading ':' or '*' into the
+// parameter name and the constraint without angle brackets.
+func splitWildcard(wildcard string) (key, constraint string) {
+	for i := 0; i < len(wildcard); i++ {
+		if wildcard[i] == '<' {
+			return wildcard[:i], wildcard[i+1 : len(wildcard)-1]
+		}
+	}
+	return wildcard, ""
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			if !isHex(s[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func allBytes(s string, f func(byte) bool) bool {
+	for i := 0; i < len(s); i++ {
+		if !f(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool { return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+func isAlnum(c byte) bool { return isAlpha(c) || isDigit(c) }
+func isHex(c byte) bool   { return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F' }
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestTreeConstraints(t *testing.T) {
+	tree := &node{}
+
+	routes := [...]string{
+		"/devices/:id<uuid>",
+		"/devices/:id<uuid>/readings/:n<int>",
+		"/devices/:name",
+		"/devices/:name/readings/latest",
+		"/currencies/:code<[A-Z]{3}>",
+		"/currencies/:code<[A-Z]{3}>/rates/:day<\\d{4}-\\d{2}-\\d{2}>",
+		"/hex/:v<hex>/*rest",
+		"/paths/:p<a/b|c>",
+	}
+	for _, route := range routes {
+		tree.addRoute(route, fakeHandler(route))
+	}
+
+	//printChildren(tree, "")
+
+	const uuid = "9f4e8a1c-0d2b-4a6e-8c3f-5b7d9e1a2c4f"
+	checkRequests(t, tree, testRequests{
+		{"/devices/" + uuid, false, "/devices/:id<uuid>", Params{Param{"id", uuid}}},
+		{"/devices/lamp", false, "/devices/:name", Params{Param{"name", "lamp"}}},
+		{"/devices/" + uuid + "/readings/-12", false, "/devices/:id<uuid>/readings/:n<int>", Params{Param{"id", uuid}, Param{"n", "-12"}}},
+		{"/devices/" + uuid + "/readings/latest", false, "/devices/:name/readings/latest", Params{Param{"name", uuid}}},
+		{"/devices/lamp/readings/latest", false, "/devices/:name/readings/latest", Params{Param{"name", "lamp"}}},
+		{"/currencies/EUR", false, "/currencies/:code<[A-Z]{3}>", Params{Param{"code", "EUR"}}},
+		{"/currencies/EURO", true, "", nil},
+		{"/currencies/eur", true, "", nil},
+		{"/currencies/USD/rates/2018-02-12", false, "/currencies/:code<[A-Z]{3}>/rates/:day<\\d{4}-\\d{2}-\\d{2}>", Params{Param{"code", "USD"}, Param{"day", "2018-02-12"}}},
+		{"/currencies/USD/rates/today", true, "", Params{Param{"code", "USD"}}},
+		{"/hex/00ff/a/b", false, "/hex/:v<hex>/*rest", Params{Param{"v", "00ff"}, Param{"rest", "/a/b"}}},
+		{"/hex/xyz/a", true, "", nil},
+		{"/paths/c", false, "/paths/:p<a/b|c>", Params{Param{"p", "c"}}},
+	})
+
+	checkPriorities(t, tree)
+	checkMaxParams(t, tree)
+
+	if path, found := tree.findCaseInsensitivePath("/CURRENCIES/EUR", false); !found || string(path) != "/currencies/EUR" {
+		t.Errorf("case insensitive lookup: got %q %v", path, found)
+	}
+	if _, found := tree.findCaseInsensitivePath("/CURRENCIES/eur", false); found {
+		t.Error("case insensitive lookup ignored the constraint")
+	}
+}
+
+func TestTreeConstraintConflicts(t *testing.T) {
+	testRoutes(t, []testRoute{
+		{"/items/:id<int>", false},
+		{"/items/:n<int>", true},
+		{"/items/:id<uuid>", false},
+		{"/items/:slug", false},
+		{"/items/:id<int>/parts", false},
+		{"/bad/:id<int", true},
+		{"/bad/:id<>", true},
+		{"/bad/:id<[>", true},
+		{"/bad/:id<int>:n", true},
+		{"/bad/*rest<int>", true},
+		{"/bad/:<int>", true},
+	})
+}
+
+func TestConstraintsRouter(t *testing.T) {
+	router := New(JwtConfig{})
+	var got string
+	handle := func(route string) Handle {
+		return func(_ http.ResponseWriter, _ *http.Request, ps Params, _ Jwt) {
+			got = route + " " + ps.ByName("n")
+		}
+	}
+	router.GET("/pages/:n<uint>", handle("page"), Name("page"))
+	router.GET("/codes/:n<alpha>", handle("code"))
+
+	for path, want := range map[string]string{"/pages/3": "page 3", "/codes/abc": "code abc"} {
+		got = ""
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || got != want {
+			t.Errorf("%s: got %d %q, want %q", path, w.Code, got, want)
+		}
+	}
+	for _, path := range []string{"/pages/-3", "/pages/x", "/codes/a1"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d, want 404", path, w.Code)
+		}
+	}
+
+	if url, err := router.URL("page", "n", "7"); err != nil || url != "/pages/7" {
+		t.Errorf("URL: got %q %v", url, err)
+	}
+	if url, err := router.URL("page", "n", "seven"); err == nil {
+		t.Errorf("URL ignored the constraint: %q", url)
+	}
+
+	doc := router.OpenAPI(OpenAPIInfo{Title: "test", Version: "1"})
+	op := doc["paths"].(map[string]map[string]interface{})["/pages/{n}"]["get"].(map[string]interface{})
+	schema := op["parameters"].([]interface{})[0].(map[string]interface{})["schema"]
+	if !reflect.DeepEqual(schema, Schema{"type": "integer", "minimum": 0}) {
+		t.Errorf("wrong parameter schema: %v", schema)
+	}
+}
+
+func TestRouterParamNames(t *testing.T) {
+	router := New(JwtConfig{})
+	names := func(w http.ResponseWriter, _ *http.Request, ps Params, _ Jwt) {
+		for _, p := range ps {
+			fmt.Fprintf(w, "%s=%s ", p.Key, p.Value)
+		}
+	}
+	// without another parameter in the segment, the name runs to its end
+	router.GET("/users/:user-id", names)
+	router.GET("/dl/:file.tar.gz/info", names)
+	router.GET("/files/:name<[^/]+>.json", names)
+	router.GET("/range/:from-:to", names)
+	router.GET("/v:version/status", names)
+
+	for path, want := range map[string]string{
+		"/users/42":       "user-id=42 ",
+		"/dl/x/info":      "file.tar.gz=x ",
+		"/files/a.b.json": "name=a.b ",
+		"/range/3-7":      "from=3 to=7 ",
+		"/v2/status":      "version=2 ",
+	} {
+		if code, body := serveRoute(router, "", path); code != http.StatusOK || body != want {
+			t.Errorf("%s: got %d %q, want %q", path, code, body, want)
+		}
+	}
+}
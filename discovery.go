@@ -0,0 +1,223 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrProviderUnavailable is returned for every token while a JwtConfig created
+// in degraded mode has not yet reached its identity provider.
+var ErrProviderUnavailable = errors.New("identity provider unavailable")
+
+// DiscoveryOptions controls how NewJwtConfigFromIssuer reaches the provider.
+type DiscoveryOptions struct {
+	// Client is used for discovery and JWKS requests.
+	// If it is nil, a client with a 10 second timeout is used.
+	Client *http.Client
+
+	// Attempts is the number of discovery requests before giving up.
+	// Defaults to 5.
+	Attempts int
+
+	// Backoff is the wait time after the first failed attempt. It doubles
+	// after every further attempt up to MaxBackoff.
+	// Defaults to 500ms and 30s.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// If Degraded is set and the provider cannot be reached, a config is
+	// returned anyway. Discovery then continues in the background and all
+	// tokens are rejected with ErrProviderUnavailable until it succeeds.
+	Degraded bool
+
+	// Logger receives warnings about failed discovery and is set as
+	// JwtConfig.Logger. If it is nil, nothing is logged.
+	Logger Logger
+
+	// Context stops the retries when it is done. In degraded mode discovery
+	// continues in the background until it succeeds, so cancel the context
+	// once the config is no longer used. Defaults to context.Background().
+	Context context.Context
+}
+
+// Discovery is the subset of the OpenID Connect discovery document used by
+// the router.
+type Discovery struct {
+	Issuer                           string   `json:"issuer"`
+	JwksUri                          string   `json:"jwks_uri"`
+	TokenEndpoint                    string   `json:"token_endpoint"`
+	IntrospectionEndpoint            string   `json:"introspection_endpoint"`
+	IdTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// Discover fetches the OpenID Connect discovery document of the issuer.
+func Discover(client *http.Client, issuer string) (discovery Discovery, err error) {
+	err = getJSON(client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return
+	}
+	if discovery.Issuer != issuer {
+		err = fmt.Errorf("discovery document issuer %q does not match %q", discovery.Issuer, issuer)
+		return
+	}
+	if discovery.JwksUri == "" {
+		err = errors.New("discovery document without jwks_uri")
+	}
+	return
+}
+
+// asymmetricAlgorithms returns the algorithms of supported that are among
+// defaultAlgorithms. Providers also list symmetric algorithms and "none",
+// which must never be accepted for tokens verified with a JWKS.
+func asymmetricAlgorithms(supported []string) (algorithms []string) {
+	for _, alg := range supported {
+		if contains(defaultAlgorithms, alg) {
+			algorithms = append(algorithms, alg)
+		}
+	}
+	return algorithms
+}
+
+// NewJwtConfigFromIssuer creates a JwtConfig from the discovery document of
+// the given issuer URL. Tokens are validated against the provider's JWKS, their
+// "iss" claim must equal the issuer and their algorithm must be an RSA,
+// RSA-PSS or ECDSA algorithm the provider supports.
+// Failed fetches are retried with exponential backoff. If the provider is
+// still unreachable afterwards, an error is returned unless opts.Degraded is
+// set.
+func NewJwtConfigFromIssuer(issuer string, opts DiscoveryOptions) (JwtConfig, error) {
+	opts = opts.withDefaults()
+	conf := JwtConfig{Issuer: issuer, Logger: opts.Logger}
+	logger := orNop(opts.Logger)
+
+	discovery, err := discoverWithRetry(issuer, opts, opts.Attempts)
+	if err == nil {
+		keys := NewJWKS(discovery.JwksUri)
+		keys.Client = opts.Client
+		keys.Logger = opts.Logger
+		conf.Keys = keys
+		conf.Algorithms = asymmetricAlgorithms(discovery.IdTokenSigningAlgValuesSupported)
+		return conf, nil
+	}
+	if !opts.Degraded {
+		return conf, fmt.Errorf("discovery of %s failed: %v", issuer, err)
+	}
+
+	logger.Log(LevelWarn, "discovery failed, continuing in degraded mode", Field{"issuer", issuer}, Field{"error", err})
+	keys := &pendingKeys{}
+	go func() {
+		// retry until the provider is reachable or the context is done
+		discovery, err := discoverWithRetry(issuer, opts, 0)
+		if err != nil {
+			logger.Log(LevelWarn, "discovery stopped", Field{"issuer", issuer}, Field{"error", err})
+			return
+		}
+		jwks := NewJWKS(discovery.JwksUri)
+		jwks.Client = opts.Client
+		jwks.Logger = opts.Logger
+		keys.set(jwks, asymmetricAlgorithms(discovery.IdTokenSigningAlgValuesSupported))
+		logger.Log(LevelInfo, "discovery succeeded, leaving degraded mode", Field{"issuer", issuer})
+	}()
+	conf.Keys = keys
+	return conf, nil
+}
+
+func (opts DiscoveryOptions) withDefaults() DiscoveryOptions {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+	if opts.Attempts <= 0 {
+		opts.Attempts = 5
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	return opts
+}
+
+// discoverWithRetry tries attempts times, or until opts.Context is done if
+// attempts is 0.
+func discoverWithRetry(issuer string, opts DiscoveryOptions, attempts int) (discovery Discovery, err error) {
+	backoff := opts.Backoff
+	for i := 1; ; i++ {
+		discovery, err = Discover(opts.Client, issuer)
+		if err == nil || i == attempts {
+			return
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-opts.Context.Done():
+			timer.Stop()
+			return discovery, opts.Context.Err()
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+	}
+}
+
+// pendingKeys rejects all tokens until the background discovery of a degraded
+// JwtConfig has succeeded.
+type pendingKeys struct {
+	mu         sync.RWMutex
+	keys       KeySource
+	algorithms []string
+}
+
+func (p *pendingKeys) set(keys KeySource, algorithms []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.algorithms = algorithms
+}
+
+func (p *pendingKeys) PublicKey(kid, alg string) (crypto.PublicKey, error) {
+	p.mu.RLock()
+	keys, algorithms := p.keys, p.algorithms
+	p.mu.RUnlock()
+	if keys == nil {
+		return nil, ErrProviderUnavailable
+	}
+	if len(algorithms) > 0 && !contains(algorithms, alg) {
+		return nil, fmt.Errorf("unexpected signing method: %v", alg)
+	}
+	return keys.PublicKey(kid, alg)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
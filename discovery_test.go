@@ -0,0 +1,146 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SmartEnergyPlatform/jwt-http-router"
+	"github.com/SmartEnergyPlatform/jwt-http-router/oidctest"
+)
+
+func serveWithAuth(router *jwt_http_router.Router, auth string) int {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", auth)
+	router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func noopHandle(http.ResponseWriter, *http.Request, jwt_http_router.Params, jwt_http_router.Jwt) {}
+
+func TestNewJwtConfigFromIssuer(t *testing.T) {
+	idp := oidctest.NewProvider()
+	defer idp.Close()
+	idp.AddUser(oidctest.User{Username: "alice"})
+
+	conf, err := jwt_http_router.NewJwtConfigFromIssuer(idp.Issuer(), jwt_http_router.DiscoveryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Issuer != idp.Issuer() || !reflect.DeepEqual(conf.Algorithms, []string{"RS256"}) {
+		t.Errorf("wrong config: %+v", conf)
+	}
+
+	router := jwt_http_router.New(conf)
+	router.GET("/me", noopHandle)
+	if code := serveWithAuth(router, idp.Authorization("alice")); code != http.StatusOK {
+		t.Errorf("valid token rejected: %d", code)
+	}
+
+	foreign, _ := idp.TokenWithClaims("alice", map[string]interface{}{"iss": "http://evil.example.com"})
+	if code := serveWithAuth(router, "Bearer "+foreign); code != http.StatusUnauthorized {
+		t.Errorf("token of foreign issuer accepted: %d", code)
+	}
+}
+
+func TestNewJwtConfigFromIssuerUnreachable(t *testing.T) {
+	idp := oidctest.NewProvider()
+	issuer := idp.Issuer()
+	idp.Close()
+
+	opts := jwt_http_router.DiscoveryOptions{Attempts: 2, Backoff: time.Millisecond}
+	if _, err := jwt_http_router.NewJwtConfigFromIssuer(issuer, opts); err == nil {
+		t.Error("expected error for unreachable provider")
+	}
+}
+
+func TestNewJwtConfigFromIssuerDegraded(t *testing.T) {
+	idp := oidctest.NewProvider()
+	defer idp.Close()
+	idp.AddUser(oidctest.User{Username: "alice"})
+	idp.SetAvailable(false)
+
+	opts := jwt_http_router.DiscoveryOptions{Attempts: 1, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, Degraded: true}
+	conf, err := jwt_http_router.NewJwtConfigFromIssuer(idp.Issuer(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := jwt_http_router.New(conf)
+	router.GET("/me", noopHandle)
+	if code := serveWithAuth(router, idp.Authorization("alice")); code != http.StatusUnauthorized {
+		t.Errorf("token accepted in degraded mode: %d", code)
+	}
+
+	idp.SetAvailable(true)
+	deadline := time.Now().Add(2 * time.Second)
+	for serveWithAuth(router, idp.Authorization("alice")) != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("router did not leave degraded mode")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewJwtConfigFromIssuerAlgorithms(t *testing.T) {
+	var issuer string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Keycloak lists its HMAC algorithms, other providers "none"
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"issuer": "` + issuer + `", "jwks_uri": "` + issuer + `/certs",
+			"id_token_signing_alg_values_supported": ["HS256", "RS256", "none", "HS512", "ES256"]}`))
+	}))
+	defer server.Close()
+	issuer = server.URL
+
+	conf, err := jwt_http_router.NewJwtConfigFromIssuer(issuer, jwt_http_router.DiscoveryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf.Algorithms, []string{"RS256", "ES256"}) {
+		t.Errorf("got algorithms %v, want [RS256 ES256]", conf.Algorithms)
+	}
+}
+
+func TestNewJwtConfigFromIssuerDegradedCancel(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := jwt_http_router.DiscoveryOptions{Attempts: 1, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, Degraded: true, Context: ctx}
+	if _, err := jwt_http_router.NewJwtConfigFromIssuer(server.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	stopped := atomic.LoadInt32(&hits)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&hits); n != stopped {
+		t.Errorf("discovery continued after cancel: %d more requests", n-stopped)
+	}
+}
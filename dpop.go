@@ -0,0 +1,284 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	// ErrDPoPRequired is returned if a route or JwtConfig.DPoP requires a
+	// DPoP bound token but the request has none.
+	ErrDPoPRequired = errors.New("dpop bound token required")
+
+	// ErrInvalidDPoPProof is returned for missing, malformed or replayed
+	// DPoP proofs and proofs not matching the request or the token.
+	ErrInvalidDPoPProof = errors.New("invalid dpop proof")
+)
+
+// Confirmation is the "cnf" claim of a token, binding it to a key (RFC 7800).
+type Confirmation struct {
+	// JKT is the JWK SHA-256 thumbprint of a DPoP key (RFC 9449).
+	JKT string `json:"jkt,omitempty"`
+
+	// X5tS256 is the SHA-256 thumbprint of a TLS client certificate (RFC 8705).
+	X5tS256 string `json:"x5t#S256,omitempty"`
+}
+
+// DPoPConfig configures the validation of DPoP proofs (RFC 9449). Proofs are
+// validated for every token with a "cnf.jkt" claim, whether or not DPoP is
+// configured; the defaults below then apply.
+type DPoPConfig struct {
+	// Required rejects bearer tokens which are not DPoP bound. Single routes
+	// can require bound tokens with RequireDPoP.
+	Required bool
+
+	// MaxAge is the accepted age of a proof by its "iat" claim, Leeway the
+	// accepted clock skew for proofs from the future.
+	// Defaults to 60s and 5s.
+	MaxAge time.Duration
+	Leeway time.Duration
+
+	// Algorithms of accepted proofs. Defaults to the RSA, RSA-PSS and ECDSA
+	// algorithms.
+	Algorithms []string
+
+	// ReplayCache records the "jti" of every proof. Defaults to a cache in
+	// memory shared by all configs.
+	ReplayCache ReplayCache
+
+	// If TrustForwardedHeaders is set, X-Forwarded-Proto and X-Forwarded-Host
+	// are used to reconstruct the request URL compared with "htu".
+	TrustForwardedHeaders bool
+}
+
+// ReplayCache detects reused proof ids.
+// Implementations must be safe for concurrent use.
+type ReplayCache interface {
+	// Seen records id until expiry and reports whether it was recorded before.
+	Seen(id string, expiry time.Time) bool
+}
+
+var defaultDPoPConfig = &DPoPConfig{}
+
+var defaultReplayCache = NewMemoryReplayCache()
+
+// RequireDPoP makes a route accept only DPoP bound bearer tokens.
+func RequireDPoP() RouteOption {
+	return func(route *Route) {
+		route.DPoP = true
+	}
+}
+
+// verifyBinding checks the DPoP proof and client certificate of bound tokens
+// and rejects unbound tokens if DPoP is required. An accepted DPoP proof is
+// recorded in token.
+func (conf JwtConfig) verifyBinding(r *http.Request, auth string, token *Jwt) error {
+	if token.Confirmation != nil && token.Confirmation.X5tS256 != "" {
+		if err := verifyCertificateBinding(r, token.Confirmation.X5tS256); err != nil {
+			return err
+		}
+	}
+	if token.Confirmation != nil && token.Confirmation.JKT != "" {
+		if err := conf.DPoP.verifyDPoP(r, auth, token.Confirmation.JKT); err != nil {
+			return err
+		}
+		token.dpopProof = r.Header.Get("DPoP")
+		return nil
+	}
+	if (conf.DPoP != nil && conf.DPoP.Required) || strings.HasPrefix(auth, "DPoP ") {
+		return ErrDPoPRequired
+	}
+	return nil
+}
+
+// verifyDPoP validates the DPoP proof of r for a token bound to jkt.
+func (conf *DPoPConfig) verifyDPoP(r *http.Request, auth string, jkt string) error {
+	if conf == nil {
+		conf = defaultDPoPConfig
+	}
+	proofs := r.Header["Dpop"]
+	if len(proofs) != 1 {
+		return ErrInvalidDPoPProof
+	}
+
+	var proofKey jwk
+	algorithms := conf.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = defaultAlgorithms
+	}
+	parser := jwt.Parser{ValidMethods: algorithms, SkipClaimsValidation: true}
+	proof, err := parser.Parse(proofs[0], func(token *jwt.Token) (interface{}, error) {
+		if token.Header["typ"] != "dpop+jwt" {
+			return nil, ErrInvalidDPoPProof
+		}
+		raw, ok := token.Header["jwk"].(map[string]interface{})
+		if !ok {
+			return nil, ErrInvalidDPoPProof
+		}
+		if _, private := raw["d"]; private {
+			return nil, ErrInvalidDPoPProof
+		}
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(b, &proofKey); err != nil {
+			return nil, err
+		}
+		return proofKey.publicKey()
+	})
+	if err != nil || !proof.Valid {
+		return ErrInvalidDPoPProof
+	}
+	if thumbprint, err := proofKey.thumbprint(); err != nil || thumbprint != jkt {
+		return ErrInvalidDPoPProof
+	}
+
+	claims, ok := proof.Claims.(jwt.MapClaims)
+	if !ok {
+		return ErrInvalidDPoPProof
+	}
+	htm, _ := claims["htm"].(string)
+	htu, _ := claims["htu"].(string)
+	jti, _ := claims["jti"].(string)
+	ath, _ := claims["ath"].(string)
+	iat, _ := claims["iat"].(float64)
+	if htm != r.Method || !conf.matchesURL(htu, r) || jti == "" {
+		return ErrInvalidDPoPProof
+	}
+	if authParts := strings.SplitN(auth, " ", 2); len(authParts) != 2 || ath != tokenHash(authParts[1]) {
+		return ErrInvalidDPoPProof
+	}
+
+	maxAge, leeway := conf.MaxAge, conf.Leeway
+	if maxAge <= 0 {
+		maxAge = time.Minute
+	}
+	if leeway <= 0 {
+		leeway = 5 * time.Second
+	}
+	issued := time.Unix(int64(iat), 0)
+	now := time.Now()
+	if issued.Before(now.Add(-maxAge)) || issued.After(now.Add(leeway)) {
+		return ErrInvalidDPoPProof
+	}
+
+	if accepted, ok := r.Context().Value(dpopProofContextKey{}).(string); ok && accepted == proofs[0] {
+		// a router mounting this one already accepted the proof for the
+		// request, so it is no replay
+		return nil
+	}
+	cache := conf.ReplayCache
+	if cache == nil {
+		cache = defaultReplayCache
+	}
+	if cache.Seen(jkt+":"+jti, issued.Add(maxAge+leeway)) {
+		return ErrInvalidDPoPProof
+	}
+	return nil
+}
+
+// matchesURL reports whether the htu claim of a proof names the URL of r,
+// ignoring query, fragment and the case of scheme and host. The path is the
+// one the client sent, also in mounted routers.
+func (conf *DPoPConfig) matchesURL(htu string, r *http.Request) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if conf.TrustForwardedHeaders {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			scheme = proto
+		}
+		if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+			host = forwarded
+		}
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return strings.EqualFold(u.Scheme, scheme) && strings.EqualFold(u.Host, host) && path == requestPath(r)
+}
+
+// tokenHash is the "ath" claim value for an access token.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// thumbprint computes the RFC 7638 JWK SHA-256 thumbprint.
+func (j jwk) thumbprint() (string, error) {
+	var canonical string
+	switch j.Kty {
+	case "RSA":
+		canonical = `{"e":"` + j.E + `","kty":"RSA","n":"` + j.N + `"}`
+	case "EC":
+		canonical = `{"crv":"` + j.Crv + `","kty":"EC","x":"` + j.X + `","y":"` + j.Y + `"}`
+	default:
+		return "", errors.New("unsupported key type " + j.Kty)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// MemoryReplayCache is a ReplayCache in memory.
+type MemoryReplayCache struct {
+	mu        sync.Mutex
+	ids       map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewMemoryReplayCache returns an empty cache.
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{ids: map[string]time.Time{}, lastSweep: time.Now()}
+}
+
+// Seen implements the ReplayCache interface.
+func (c *MemoryReplayCache) Seen(id string, expiry time.Time) bool {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) > time.Minute {
+		for k, exp := range c.ids {
+			if now.After(exp) {
+				delete(c.ids, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	if exp, ok := c.ids[id]; ok && now.Before(exp) {
+		return true
+	}
+	c.ids[id] = expiry
+	return false
+}
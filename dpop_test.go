@@ -0,0 +1,164 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+type dpopClient struct {
+	t   *testing.T
+	key *ecdsa.PrivateKey
+	jwk jwk
+}
+
+func newDPoPClient(t *testing.T) *dpopClient {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dpopClient{t: t, key: key, jwk: jwk{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}}
+}
+
+func (c *dpopClient) thumbprint() string {
+	thumbprint, err := c.jwk.thumbprint()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return thumbprint
+}
+
+func (c *dpopClient) proof(method, url, accessToken string, iat time.Time) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"jti": randomTestId(c.t),
+		"htm": method,
+		"htu": url,
+		"iat": iat.Unix(),
+		"ath": tokenHash(accessToken),
+	})
+	token.Header["typ"] = "dpop+jwt"
+	token.Header["jwk"] = map[string]string{"kty": "EC", "crv": "P-256", "x": c.jwk.X, "y": c.jwk.Y}
+	proof, err := token.SignedString(c.key)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return proof
+}
+
+func randomTestId(t *testing.T) string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestJwkThumbprint(t *testing.T) {
+	// example of RFC 7638, section 3.1
+	key := jwk{
+		Kty: "RSA",
+		E:   "AQAB",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMs" +
+			"tn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91" +
+			"CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+	}
+	thumbprint, err := key.thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumbprint != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("wrong thumbprint: %s", thumbprint)
+	}
+}
+
+func TestDPoP(t *testing.T) {
+	key := newTestKey(t)
+	client := newDPoPClient(t)
+	router := New(JwtConfig{PubRsa: string(publicKeyPEM(t, key)), DPoP: &DPoPConfig{ReplayCache: NewMemoryReplayCache()}})
+	handle := func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {}
+	router.GET("/devices/:id", handle)
+	router.GET("/secure", handle, RequireDPoP())
+
+	bound, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "alice",
+		"cnf": map[string]string{"jkt": client.thumbprint()},
+	}).SignedString(key)
+	unbound, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice"}).SignedString(key)
+
+	serve := func(path, token, proof string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path+"?q=1", nil)
+		req.Host = "api.example.com"
+		req.Header.Set("Authorization", "DPoP "+token)
+		if proof != "" {
+			req.Header.Set("DPoP", proof)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	now := time.Now()
+	valid := client.proof("GET", "http://api.example.com/devices/1", bound, now)
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		proof string
+		code  int
+	}{
+		{"valid proof", "/devices/1", bound, valid, 200},
+		{"replayed proof", "/devices/1", bound, valid, 401},
+		{"missing proof", "/devices/1", bound, "", 401},
+		{"wrong method", "/devices/1", bound, client.proof("POST", "http://api.example.com/devices/1", bound, now), 401},
+		{"wrong url", "/devices/1", bound, client.proof("GET", "http://api.example.com/devices/2", bound, now), 401},
+		{"stale proof", "/devices/1", bound, client.proof("GET", "http://api.example.com/devices/1", bound, now.Add(-time.Hour)), 401},
+		{"wrong access token hash", "/devices/1", bound, client.proof("GET", "http://api.example.com/devices/1", unbound, now), 401},
+		{"foreign key", "/devices/1", bound, newDPoPClient(t).proof("GET", "http://api.example.com/devices/1", bound, now), 401},
+		{"unbound token with dpop scheme", "/devices/1", unbound, client.proof("GET", "http://api.example.com/devices/1", unbound, now), 401},
+		{"route requiring dpop", "/secure", bound, client.proof("GET", "http://API.example.com/secure", bound, now), 200},
+	}
+	for _, test := range tests {
+		if code := serve(test.path, test.token, test.proof); code != test.code {
+			t.Errorf("%s: got %d, want %d", test.name, code, test.code)
+		}
+	}
+
+	// unbound bearer tokens work on routes not requiring dpop only
+	for path, want := range map[string]int{"/devices/1": 200, "/secure": 401} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+unbound)
+		router.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("unbound token on %s: got %d, want %d", path, w.Code, want)
+		}
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/SmartEnergyPlatform/jwt-http-router
 
+go 1.19
+
 require github.com/dgrijalva/jwt-go v3.1.0+incompatible
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"strings"
+)
+
+// Host restricts a route to requests for hosts matching pattern. Patterns use
+// the syntax of paths without catch-all parameters, with '.' separating the
+// labels like '/' separates path segments, e.g. "api.example.com" or
+// ":tenant.example.com". A host parameter matches exactly one label, so
+// ":tenant.example.com" does not match "a.b.example.com". The values of host
+// parameters come first in the Params of the request.
+//
+// Every host pattern has its own routes. Requests for hosts matching no
+// pattern are routed to the routes without Host.
+func Host(pattern string) RouteOption {
+	return func(route *Route) {
+		route.Host = strings.ToLower(pattern)
+	}
+}
+
+// treesFor returns the method trees for the Host header of a request and the
+// values of the host parameters.
+func (t *routeTable) treesFor(host string) (map[string]*node, Params) {
+	if t.hosts == nil {
+		return t.trees, nil
+	}
+	host = normalizeHost(host)
+	if strings.ContainsRune(host, '/') {
+		return t.trees, nil
+	}
+	leaf, ps, _ := t.hosts.getLeaf(hostPath(host))
+	if leaf == nil {
+		return t.trees, nil
+	}
+	return t.hostTrees[leaf.route.Host], ps
+}
+
+// normalizeHost removes the port and a trailing dot of host and converts it
+// to lower case.
+func normalizeHost(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && i > strings.LastIndexByte(host, ']') {
+		host = host[:i]
+	}
+	host = strings.TrimSuffix(host, ".")
+	return strings.ToLower(host)
+}
+
+// hostPath converts a host or host pattern to the path stored in the host
+// tree, which has the labels as segments, e.g. ":tenant.example.com" becomes
+// "/:tenant/example/com". Dots in constraints are kept.
+func hostPath(host string) string {
+	b := []byte("/" + host)
+	depth := 0
+	for i, c := range b {
+		switch c {
+		case '<':
+			depth++
+		case '>':
+			if depth > 0 {
+				depth--
+			}
+		case '.':
+			if depth == 0 {
+				b[i] = '/'
+			}
+		}
+	}
+	return string(b)
+}
+
+// mergeParams returns the host parameters followed by the path parameters.
+func mergeParams(host, path Params) Params {
+	if len(host) == 0 {
+		return path
+	}
+	if len(path) == 0 {
+		return host
+	}
+	ps := make(Params, 0, len(host)+len(path))
+	return append(append(ps, host...), path...)
+}
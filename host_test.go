@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRouterHost(t *testing.T) {
+	router := New(JwtConfig{})
+	var got string
+	var params Params
+	handle := func(name string) Handle {
+		return func(_ http.ResponseWriter, _ *http.Request, ps Params, _ Jwt) {
+			got, params = name, ps
+		}
+	}
+	router.GET("/status", handle("default"))
+	router.GET("/status", handle("api"), Host("API.example.com"))
+	router.GET("/status", handle("tenant"), Host(":tenant.example.com"))
+	router.GET("/users/:id", handle("tenant user"), Host(":tenant.example.com"), ParamTypes(map[string]ParamType{"id": ParamInt}))
+	router.GET("/status", handle("region"), Host(":tenant.:region<[a-z]{2}>.example.net"))
+
+	tests := []struct {
+		host, path string
+		want       string
+		params     Params
+	}{
+		{"example.org", "/status", "default", nil},
+		{"api.example.com", "/status", "api", nil},
+		{"Api.Example.Com.:8080", "/status", "api", nil},
+		{"acme.example.com", "/status", "tenant", Params{{"tenant", "acme"}}},
+		{"acme.example.com:443", "/users/42", "tenant user", Params{{"tenant", "acme"}, {"id", "42"}}},
+		{"acme.eu.example.net", "/status", "region", Params{{"tenant", "acme"}, {"region", "eu"}}},
+		// host parameters match a single label
+		{"acme.north.example.com", "/status", "default", nil},
+		{"acme.example.com.example.com", "/status", "default", nil},
+		{"[::1]:8080", "/status", "default", nil},
+	}
+	for _, test := range tests {
+		got, params = "", nil
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || got != test.want || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("%s%s: got %d %q %v, want %q %v", test.host, test.path, w.Code, got, params, test.want, test.params)
+		}
+	}
+
+	// known hosts do not fall back to the routes without host
+	router.GET("/only-default", handle("only default"))
+	req := httptest.NewRequest("GET", "/only-default", nil)
+	req.Host = "acme.example.com"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("known host fell back: %d", w.Code)
+	}
+
+	// declared types apply to the routes of a host
+	req = httptest.NewRequest("GET", "/users/me", nil)
+	req.Host = "acme.example.com"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid parameter of host route: %d", w.Code)
+	}
+
+	var hosts []string
+	for _, route := range router.Routes() {
+		hosts = append(hosts, route.Host)
+	}
+	if want := []string{"", "", ":tenant.:region<[a-z]{2}>.example.net", ":tenant.example.com", ":tenant.example.com", "api.example.com"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("wrong hosts of routes: %q", hosts)
+	}
+
+	noop := func(_ http.ResponseWriter, _ *http.Request, _ Params, _ Jwt) {}
+	for _, host := range []string{"example.com/x", "*.example.com"} {
+		if recv := catchPanic(func() { router.GET("/x", noop, Host(host)) }); recv == nil {
+			t.Errorf("no panic for host pattern %q", host)
+		}
+	}
+	if recv := catchPanic(func() { router.GET("/x/:tenant", noop, Host(":tenant.example.com")) }); recv == nil {
+		t.Error("no panic for parameter of host and path with the same name")
+	}
+}
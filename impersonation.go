@@ -0,0 +1,55 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrImpersonationDenied is returned if the impersonation header is sent by a
+// caller without one of the configured impersonation roles.
+var ErrImpersonationDenied = errors.New("impersonation not permitted")
+
+// impersonate switches token to the user requested by the impersonation
+// header. The original user is kept as Actor and recorded in the audit log,
+// if Router.Audit is set.
+func (conf JwtConfig) impersonate(r *http.Request, token *Jwt) error {
+	if conf.ImpersonationHeader != "" && len(conf.ImpersonationRoles) > 0 {
+		if subject := r.Header.Get(conf.ImpersonationHeader); subject != "" {
+			if !token.hasAnyRealmRole(conf.ImpersonationRoles) {
+				return ErrImpersonationDenied
+			}
+			token.Actor = &Actor{UserId: token.UserId, Actor: token.Actor}
+			token.UserId = subject
+			token.RealmAccess = Resource{Roles: conf.ImpersonatedRoles}
+			token.ResourceAccess = nil
+			token.Map["sub"] = subject
+			token.Map["act"] = token.Actor
+		}
+	}
+	return nil
+}
+
+func (token Jwt) hasAnyRealmRole(roles []string) bool {
+	for _, role := range token.RealmAccess.Roles {
+		if contains(roles, role) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestImpersonationHeader(t *testing.T) {
+	key := newTestKey(t)
+	router := New(JwtConfig{
+		PubRsa:              string(publicKeyPEM(t, key)),
+		ImpersonationHeader: "X-Impersonate-User",
+		ImpersonationRoles:  []string{"support"},
+		ImpersonatedRoles:   []string{"user"},
+	})
+	var got Jwt
+	router.GET("/me", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {
+		got = jwt
+	})
+	serve := func(roles []interface{}, impersonate string) int {
+		got = Jwt{}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.Header.Set("Authorization", signedAuth(t, key, jwt.SigningMethodRS256, jwt.MapClaims{
+			"sub":          "staff",
+			"realm_access": map[string]interface{}{"roles": roles},
+		}))
+		if impersonate != "" {
+			req.Header.Set("X-Impersonate-User", impersonate)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := serve([]interface{}{"support", "admin"}, "customer"); code != http.StatusOK {
+		t.Fatalf("impersonation rejected: %d", code)
+	}
+	if got.UserId != "customer" || got.Actor == nil || got.Actor.UserId != "staff" {
+		t.Errorf("wrong identity: user=%q actor=%+v", got.UserId, got.Actor)
+	}
+	if !reflect.DeepEqual(got.RealmAccess.Roles, []string{"user"}) {
+		t.Errorf("impersonated identity kept roles of actor: %v", got.RealmAccess.Roles)
+	}
+
+	if code := serve([]interface{}{"user"}, "customer"); code != http.StatusUnauthorized {
+		t.Errorf("impersonation without role accepted: %d", code)
+	}
+
+	if code := serve([]interface{}{"support"}, ""); code != http.StatusOK || got.UserId != "staff" || got.Actor != nil {
+		t.Errorf("request without header was impersonated: %d %q %+v", code, got.UserId, got.Actor)
+	}
+}
+
+func TestImpersonationActClaim(t *testing.T) {
+	token := Jwt{}
+	token.Map = map[string]interface{}{}
+	claims := jwt.MapClaims{
+		"sub": "customer",
+		"act": map[string]interface{}{"sub": "staff", "act": map[string]interface{}{"sub": "gateway"}},
+	}
+	auth, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := GetJWTPayload("Bearer "+auth, &token.Map, &token); err != nil {
+		t.Fatal(err)
+	}
+	want := &Actor{UserId: "staff", Actor: &Actor{UserId: "gateway"}}
+	if token.UserId != "customer" || !reflect.DeepEqual(token.Actor, want) {
+		t.Errorf("wrong identity: user=%q actor=%+v", token.UserId, token.Actor)
+	}
+}
+
+func TestImpersonationDownstreamCallsAsActor(t *testing.T) {
+	var upstreamAuth, upstreamImpersonate string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamAuth = r.Header.Get("Authorization")
+		upstreamImpersonate = r.Header.Get("X-Impersonate-User")
+	}))
+	defer upstream.Close()
+
+	key := newTestKey(t)
+	router := New(JwtConfig{
+		PubRsa:              string(publicKeyPEM(t, key)),
+		ImpersonationHeader: "X-Impersonate-User",
+		ImpersonationRoles:  []string{"support"},
+	})
+	router.GET("/me", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {
+		resp, err := jwt.Impersonate.Get(upstream.URL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	})
+	staff := signedAuth(t, key, jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub":          "staff",
+		"realm_access": map[string]interface{}{"roles": []interface{}{"support"}},
+	})
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", staff)
+	req.Header.Set("X-Impersonate-User", "customer")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	// the handler acts as customer, but downstream calls carry the token of
+	// staff and do not impersonate
+	if upstreamAuth != staff || upstreamImpersonate != "" {
+		t.Errorf("downstream call not made as the actor: %q %q", upstreamAuth, upstreamImpersonate)
+	}
+}
@@ -21,18 +21,14 @@ import (
 	"net/http"
 	"time"
 
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
 
-	"log"
-
-	"reflect"
-
 	"io"
+	"io/ioutil"
 
 	"bytes"
 
@@ -40,50 +36,140 @@ import (
 )
 
 type JwtConfig struct {
+	// PubRsa is the public key which verifies token signatures, either base64
+	// encoded DER or PEM (public key or certificate). Every value is parsed
+	// only once, and an invalid key rejects all tokens.
 	PubRsa    string
 	ForceAuth bool
 	ForceUser bool
+
+	// Keys resolves the keys which verify token signatures. If set, it takes
+	// precedence over PubRsa and PubKeyFiles. See NewJWKS, NewKeyFiles and
+	// NewJwtConfigFromIssuer.
+	Keys KeySource
+
+	// PubKeyFiles are files with PEM encoded public keys or certificates.
+	// New loads them and reloads them every KeyReloadInterval (default 30s)
+	// if their content changed. They take precedence over PubRsa. While the
+	// files cannot be loaded, all tokens are rejected.
+	PubKeyFiles       []string
+	KeyReloadInterval time.Duration
+
+	// If Issuer is set, the "iss" claim of every token must match it.
+	Issuer string
+
+	// Algorithms lists the accepted signing algorithms of tokens verified with
+	// Keys. If it is empty, the RSA, RSA-PSS and ECDSA algorithms are accepted.
+	Algorithms []string
+
+	// TokenCache caches the claims of tokens verified with Keys. If it is
+	// nil, every token is verified on every request.
+	TokenCache *TokenCache
+
+	// Logger receives warnings about key reloads and discovery. If it is
+	// nil, nothing is logged. New also uses it as Router.Logger.
+	Logger Logger
+
+	// ImpersonationHeader names a request header, e.g. "X-Impersonate-User",
+	// with which callers holding one of the realm roles in ImpersonationRoles
+	// act on behalf of the user id given in the header. The impersonated
+	// identity gets the realm roles in ImpersonatedRoles and no client roles.
+	// Impersonation is disabled if the header or the roles are empty.
+	// Impersonation only changes the Jwt passed to the handler; calls made
+	// with Jwt.Impersonate still carry the token of the actor, see
+	// JwtImpersonate.
+	ImpersonationHeader string
+	ImpersonationRoles  []string
+	ImpersonatedRoles   []string
+
+	// DPoP configures proof-of-possession validation for DPoP bound tokens.
+	DPoP *DPoPConfig
 }
 
+// defaultAlgorithms are accepted if JwtConfig.Algorithms is empty.
+var defaultAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
 type Jwt struct {
 	UserId         string                 `json:"sub"`
 	ResourceAccess map[string]Resource    `json:"resource_access"`
 	RealmAccess    Resource               `json:"realm_access"`
 	Map            map[string]interface{} `json:"-"`
 	Impersonate    JwtImpersonate         `json:"-"`
+
+	// AuthMethod is the Method of the Authenticator which created the Jwt.
+	// It is empty for anonymous requests.
+	AuthMethod string `json:"-"`
+
+	// Confirmation binds the token to a key, see DPoPConfig.
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+
+	// Actor is set if UserId is impersonated by another user, either by the
+	// RFC 8693 "act" claim of the token or by JwtConfig.ImpersonationHeader.
+	Actor *Actor `json:"act,omitempty"`
+
+	// dpopProof is the DPoP proof verifyDPoP accepted for the request.
+	dpopProof string
+}
+
+// Actor is the party acting on behalf of the subject of a Jwt. Nested actors
+// record a chain of delegations, the outermost being the current actor.
+type Actor struct {
+	UserId string `json:"sub"`
+	Actor  *Actor `json:"act,omitempty"`
+}
+
+// JwtImpersonate calls other services with the Authorization header of a
+// request, so they act with the privileges of the caller's token. After an
+// impersonation by JwtConfig.ImpersonationHeader this is the token of the
+// actor, not of the impersonated user; services which should act as that
+// user need their own token for it, e.g. from an RFC 8693 token exchange.
+type JwtImpersonate struct {
+	Authorization string
+
+	// trace is the trace context of the request, passed on by the methods
+	// without context.
+	trace TraceContext
 }
 
-type JwtImpersonate string
+// impersonateClient is used for all JwtImpersonate requests. The timeout covers
+// the whole exchange including reading the response body.
+var impersonateClient = &http.Client{Timeout: 5 * time.Second}
 
 type Resource struct {
 	Roles []string `json:"roles"`
 }
 
-func (router *Router) jwt(r *http.Request) (token Jwt, err error) {
-	token.Map = map[string]interface{}{}
+// Method implements the Authenticator interface.
+func (conf JwtConfig) Method() string {
+	return AuthMethodBearer
+}
+
+// Authenticate implements the Authenticator interface for bearer tokens.
+// Every Authorization header except HTTP Basic is treated as a bearer token.
+func (conf JwtConfig) Authenticate(r *http.Request) (token Jwt, ok bool, err error) {
 	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		if router.JwtConf.ForceAuth {
-			err = errors.New("missing Authorization header")
-		}
-	} else {
-		if router.JwtConf.PubRsa == "" {
-			err = GetJWTPayload(auth, &token.Map, &token)
-			if err != nil {
-				log.Println("error in GetJWTPayload() ", err)
-			}
-		} else {
-			err = GetJWTPayloadAndValidate(auth, router.JwtConf.PubRsa, &token.Map, &token)
-			if err != nil {
-				log.Println("error in GetJWTPayloadAndValidate() ", err)
-			}
+	if auth == "" || isBasicAuth(auth) {
+		return token, false, nil
+	}
+	token.Map = map[string]interface{}{}
+	switch {
+	case conf.Keys != nil:
+		err = conf.validate(auth, &token.Map, &token)
+	case conf.PubRsa != "":
+		if conf.Keys, err = cachedPublicKeys(conf.PubRsa); err == nil {
+			err = conf.validate(auth, &token.Map, &token)
 		}
+	default:
+		err = GetJWTPayload(auth, &token.Map, &token)
 	}
-	if err == nil && router.JwtConf.ForceUser && token.UserId == "" {
-		err = errors.New("missing user id")
+	if err == nil {
+		err = conf.verifyBinding(r, auth, &token)
 	}
-	token.Impersonate = JwtImpersonate(auth)
-	return
+	if err == nil {
+		err = conf.impersonate(r, &token)
+	}
+	token.Impersonate = JwtImpersonate{Authorization: auth}
+	return token, true, err
 }
 
 func GetJWTPayload(auth string, results ...interface{}) (err error) {
@@ -109,14 +195,12 @@ func DecodeJWTSegment(seg string, results ...interface{}) error {
 
 	b, err := base64.URLEncoding.DecodeString(seg)
 	if err != nil {
-		log.Println("error while base64.URLEncoding.DecodeString()", err, seg)
 		return err
 	}
 
 	for _, result := range results {
 		err = json.Unmarshal(b, result)
 		if err != nil {
-			log.Println("error while json.Unmarshal()", err, reflect.TypeOf(result).Kind().String(), string(b))
 			return err
 		}
 	}
@@ -137,13 +221,12 @@ func GetJWTPayloadAndValidate(auth string, pubRsaKey string, results ...interfac
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
 
-		//decode key base64 string to []byte
-		b, err := base64.StdEncoding.DecodeString(pubRsaKey)
+		//parse base64 DER or PEM key to go struct key, once per key
+		keys, err := cachedPublicKeys(pubRsaKey)
 		if err != nil {
 			return nil, err
 		}
-		//parse []byte key to go struct key (use most common encoding)
-		return x509.ParsePKIXPublicKey(b)
+		return keys[0], nil
 	})
 
 	if err != nil {
@@ -167,35 +250,134 @@ func GetJWTPayloadAndValidate(auth string, pubRsaKey string, results ...interfac
 	return
 }
 
+// keyFiles loads conf.PubKeyFiles and watches them for changes. If they
+// cannot be loaded, the error is logged and the returned KeyFiles rejects all
+// tokens until a reload succeeds.
+func (conf JwtConfig) keyFiles() *KeyFiles {
+	interval := conf.KeyReloadInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	logger := orNop(conf.Logger)
+	files := newKeyFiles(logger, conf.PubKeyFiles...)
+	if err := files.reload(); err != nil {
+		logger.Log(LevelError, "loading key files failed, rejecting all tokens", Field{"error", err})
+	}
+	go files.watch(interval)
+	return files
+}
+
+// validate verifies the token in auth with the configured Keys, Issuer and
+// Algorithms and decodes its payload into results.
+func (conf JwtConfig) validate(auth string, results ...interface{}) (err error) {
+	authParts := strings.Split(auth, " ")
+	if len(authParts) != 2 {
+		return errors.New("expect auth string format like '<type> <token>'")
+	}
+	algorithms := conf.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = defaultAlgorithms
+	}
+	parser := jwt.Parser{ValidMethods: algorithms}
+
+	if conf.TokenCache != nil {
+		accept := func(verified tokenVerification) bool {
+			return conf.acceptsCached(verified, algorithms)
+		}
+		if b, ok := conf.TokenCache.get(authParts[1], accept); ok {
+			return unmarshalClaims(b, results...)
+		}
+	}
+
+	// key sets without key ids get each candidate key tried in order
+	var token *jwt.Token
+	verified := tokenVerification{issuer: conf.Issuer}
+	for i, candidates := 0, 1; i < candidates; i++ {
+		token, err = parser.Parse(authParts[1], func(token *jwt.Token) (interface{}, error) {
+			verified.alg = token.Method.Alg()
+			verified.kid, _ = token.Header["kid"].(string)
+			if set, ok := conf.Keys.(keySet); ok {
+				keys := set.candidates(verified.alg)
+				if candidates = len(keys); i >= candidates {
+					return nil, ErrUnknownKey
+				}
+				verified.key = keys[i]
+				return keys[i], nil
+			}
+			key, err := conf.Keys.PublicKey(verified.kid, verified.alg)
+			verified.key = key
+			return key, err
+		})
+		if ve, ok := err.(*jwt.ValidationError); !ok || ve.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return errors.New("no valida JWT payload found")
+	}
+	if conf.Issuer != "" && !claims.VerifyIssuer(conf.Issuer, true) {
+		return errors.New("unexpected token issuer")
+	}
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	if conf.TokenCache != nil {
+		var exp time.Time
+		if e, ok := claims["exp"].(float64); ok {
+			exp = time.Unix(int64(e), 0)
+		}
+		conf.TokenCache.put(authParts[1], b, exp, verified)
+	}
+	return unmarshalClaims(b, results...)
+}
+
+func unmarshalClaims(b []byte, results ...interface{}) error {
+	for _, result := range results {
+		if err := json.Unmarshal(b, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Post sends a POST request with the Authorization header and the trace
+// context of the request the Jwt was created for.
 func (this JwtImpersonate) Post(url string, contentType string, body io.Reader) (resp *http.Response, err error) {
+	return this.PostWithContext(context.Background(), url, contentType, body)
+}
+
+// PostWithContext is like Post but cancels the request with ctx and passes on
+// its trace context, see TraceFromContext, if it has one.
+func (this JwtImpersonate) PostWithContext(ctx context.Context, url string, contentType string, body io.Reader) (resp *http.Response, err error) {
 	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
 		return nil, err
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 5 * time.Second)
-	req.WithContext(ctx)
-	req.Header.Set("Authorization", string(this))
 	req.Header.Set("Content-Type", contentType)
-
-	resp, err = http.DefaultClient.Do(req)
-
-	if err == nil && resp.StatusCode >= 300 {
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(resp.Body)
-		resp.Body.Close()
-		log.Println(buf.String())
-		err = errors.New(resp.Status)
-	}
-	return
+	return this.do(ctx, req)
 }
 
+// PostJSON posts body as JSON like Post and decodes the response into result
+// unless it is nil.
 func (this JwtImpersonate) PostJSON(url string, body interface{}, result interface{}) (err error) {
+	return this.PostJSONWithContext(context.Background(), url, body, result)
+}
+
+// PostJSONWithContext is like PostJSON but cancels the request with ctx and
+// passes on its trace context.
+func (this JwtImpersonate) PostJSONWithContext(ctx context.Context, url string, body interface{}, result interface{}) (err error) {
 	b := new(bytes.Buffer)
 	err = json.NewEncoder(b).Encode(body)
 	if err != nil {
 		return
 	}
-	resp, err := this.Post(url, "application/json", b)
+	resp, err := this.PostWithContext(ctx, url, "application/json", b)
 	if err != nil {
 		return err
 	}
@@ -206,31 +388,53 @@ func (this JwtImpersonate) PostJSON(url string, body interface{}, result interfa
 	return
 }
 
+// Get sends a GET request with the Authorization header and the trace
+// context of the request the Jwt was created for.
 func (this JwtImpersonate) Get(url string) (resp *http.Response, err error) {
+	return this.GetWithContext(context.Background(), url)
+}
+
+// GetWithContext is like Get but cancels the request with ctx and passes on
+// its trace context.
+func (this JwtImpersonate) GetWithContext(ctx context.Context, url string) (resp *http.Response, err error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 5 * time.Second)
-	req.WithContext(ctx)
-	req.Header.Set("Authorization", string(this))
-	resp, err = http.DefaultClient.Do(req)
-
-	if err == nil && resp.StatusCode >= 300 {
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(resp.Body)
-		resp.Body.Close()
-		log.Println(buf.String())
-		err = errors.New(resp.Status)
-	}
-	return
+	return this.do(ctx, req)
 }
 
+// GetJSON gets url like Get and decodes the JSON response into result.
 func (this JwtImpersonate) GetJSON(url string, result interface{}) (err error) {
-	resp, err := this.Get(url)
+	return this.GetJSONWithContext(context.Background(), url, result)
+}
+
+// GetJSONWithContext is like GetJSON but cancels the request with ctx and
+// passes on its trace context.
+func (this JwtImpersonate) GetJSONWithContext(ctx context.Context, url string, result interface{}) (err error) {
+	resp, err := this.GetWithContext(ctx, url)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	return json.NewDecoder(resp.Body).Decode(result)
 }
+
+func (this JwtImpersonate) do(ctx context.Context, req *http.Request) (resp *http.Response, err error) {
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", this.Authorization)
+	tc, ok := TraceFromContext(ctx)
+	if !ok {
+		tc = this.trace
+	}
+	tc.Inject(req.Header)
+	resp, err = impersonateClient.Do(req)
+
+	if err == nil && resp.StatusCode >= 300 {
+		// the body may contain personal data and is never logged
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		err = errors.New(resp.Status)
+	}
+	return
+}
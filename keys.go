@@ -0,0 +1,474 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeySource resolves the public key which verifies the signature of a token.
+// Implementations must be safe for concurrent use.
+type KeySource interface {
+	// PublicKey returns the key for the kid and alg of a token header.
+	// kid may be empty if the token header does not name a key.
+	PublicKey(kid, alg string) (crypto.PublicKey, error)
+}
+
+// ErrUnknownKey is returned by key sources which have no key for a kid.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// keySet is implemented by key sources which hold several keys without key
+// ids, e.g. the old and the new key during a rotation. Token validation tries
+// the candidates in order.
+type keySet interface {
+	candidates(alg string) []crypto.PublicKey
+}
+
+// StaticKeys is a KeySource with a fixed list of keys. Tokens are verified
+// with every key matching the token algorithm until one succeeds.
+type StaticKeys []crypto.PublicKey
+
+// PublicKey implements the KeySource interface.
+func (s StaticKeys) PublicKey(kid, alg string) (crypto.PublicKey, error) {
+	if keys := s.candidates(alg); len(keys) > 0 {
+		return keys[0], nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func (s StaticKeys) candidates(alg string) (keys []crypto.PublicKey) {
+	for _, key := range s {
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS") {
+				keys = append(keys, key)
+			}
+		case *ecdsa.PublicKey:
+			if strings.HasPrefix(alg, "ES") {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return
+}
+
+// parsedKeys caches the keys parsed by cachedPublicKeys by their encoding.
+var parsedKeys sync.Map // string -> StaticKeys
+
+// cachedPublicKeys works like ParsePublicKeys, but parses every encoding only
+// once.
+func cachedPublicKeys(data string) (StaticKeys, error) {
+	if keys, ok := parsedKeys.Load(data); ok {
+		return keys.(StaticKeys), nil
+	}
+	keys, err := ParsePublicKeys([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	parsedKeys.Store(data, keys)
+	return keys, nil
+}
+
+// ParsePublicKeys parses all public keys in data. Accepted are PEM blocks of
+// type "PUBLIC KEY", "RSA PUBLIC KEY" and "CERTIFICATE" and, for compatibility
+// with JwtConfig.PubRsa, a single base64 encoded DER public key.
+func ParsePublicKeys(data []byte) (keys StaticKeys, err error) {
+	data = bytes.TrimSpace(data)
+	if !bytes.HasPrefix(data, []byte("-----")) {
+		der, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return nil, err
+		}
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, err
+		}
+		return StaticKeys{key}, nil
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			err = errors.New("unsupported PEM block type " + block.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public key found")
+	}
+	return keys, nil
+}
+
+// KeyFiles is a KeySource which reads keys from files and reloads them when
+// their content changes, e.g. when a mounted secret gets rotated. Each file
+// may hold several PEM encoded keys or certificates.
+type KeyFiles struct {
+	paths  []string
+	keys   atomic.Value // StaticKeys
+	sum    [sha256.Size]byte
+	done   chan struct{}
+	close  sync.Once
+	logger Logger
+}
+
+// NewKeyFiles loads the given files and checks them for changes every
+// interval. A failed reload keeps the previous keys. Close stops the watcher.
+func NewKeyFiles(interval time.Duration, paths ...string) (*KeyFiles, error) {
+	k := newKeyFiles(nopLogger{}, paths...)
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	go k.watch(interval)
+	return k, nil
+}
+
+// newKeyFiles returns KeyFiles without keys; reload loads them.
+func newKeyFiles(logger Logger, paths ...string) *KeyFiles {
+	k := &KeyFiles{paths: paths, done: make(chan struct{}), logger: logger}
+	k.keys.Store(StaticKeys(nil))
+	return k
+}
+
+// PublicKey implements the KeySource interface.
+func (k *KeyFiles) PublicKey(kid, alg string) (crypto.PublicKey, error) {
+	return k.keys.Load().(StaticKeys).PublicKey(kid, alg)
+}
+
+func (k *KeyFiles) candidates(alg string) []crypto.PublicKey {
+	return k.keys.Load().(StaticKeys).candidates(alg)
+}
+
+// Close stops watching the files. It may be called more than once.
+func (k *KeyFiles) Close() {
+	k.close.Do(func() {
+		close(k.done)
+	})
+}
+
+func (k *KeyFiles) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			if err := k.reload(); err != nil {
+				k.logger.Log(LevelWarn, "key reload failed, keeping previous keys", Field{"error", err})
+			}
+		}
+	}
+}
+
+// reload is only called by NewKeyFiles and the watcher, so k.sum needs no lock.
+func (k *KeyFiles) reload() error {
+	var contents [][]byte
+	hash := sha256.New()
+	for _, path := range k.paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		contents = append(contents, b)
+		hash.Write(b)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	if sum == k.sum {
+		return nil
+	}
+
+	var keys StaticKeys
+	for i, b := range contents {
+		parsed, err := ParsePublicKeys(b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", k.paths[i], err)
+		}
+		keys = append(keys, parsed...)
+	}
+	k.keys.Store(keys)
+	k.sum = sum
+	return nil
+}
+
+// JWKS is a KeySource backed by a remote JSON Web Key Set (RFC 7517).
+// Keys are cached and the set is fetched again when a token names an unknown
+// kid, so key rotations of the identity provider are picked up automatically.
+// Concurrent lookups share a single fetch.
+type JWKS struct {
+	URL    string
+	Client *http.Client
+
+	// MinRefreshInterval limits how often unknown kids trigger a refetch.
+	// Failed fetches count as well, so an unreachable provider is not asked
+	// again for every request.
+	MinRefreshInterval time.Duration
+
+	// MaxAge is the time after which the cached set is fetched again even if
+	// all requested kids are known, so retired keys get dropped. The fetch
+	// runs in the background and cached keys are used meanwhile.
+	MaxAge time.Duration
+
+	// Logger receives warnings about keys of the set that cannot be used.
+	// If it is nil, nothing is logged.
+	Logger Logger
+
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	attempted time.Time
+	err       error
+	pending   *jwksFetch
+}
+
+// jwksFetch is a fetch of the key set that lookups can wait for.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// NewJWKS returns a key set for the given URL. Keys are fetched lazily on the
+// first lookup; call Refresh to fetch them eagerly.
+func NewJWKS(url string) *JWKS {
+	return &JWKS{
+		URL:                url,
+		Client:             &http.Client{Timeout: 10 * time.Second},
+		MinRefreshInterval: 10 * time.Second,
+		MaxAge:             time.Hour,
+	}
+}
+
+// PublicKey implements the KeySource interface.
+func (k *JWKS) PublicKey(kid, alg string) (crypto.PublicKey, error) {
+	k.mu.RLock()
+	key, ok := k.lookup(kid)
+	fetched, attempted, err := k.fetched, k.attempted, k.err
+	k.mu.RUnlock()
+
+	throttled := !attempted.IsZero() && time.Since(attempted) < k.MinRefreshInterval
+	if ok {
+		if time.Since(fetched) >= k.MaxAge && !throttled {
+			k.refresh()
+		}
+		return key, nil
+	}
+	if throttled {
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrUnknownKey
+	}
+	if err := k.Refresh(); err != nil {
+		return nil, err
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if key, ok = k.lookup(kid); !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// lookup expects k.mu to be held.
+func (k *JWKS) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+// Refresh fetches the key set and replaces the cached keys. If a fetch is
+// already running, Refresh waits for it instead of starting another one.
+func (k *JWKS) Refresh() error {
+	f := k.refresh()
+	<-f.done
+	return f.err
+}
+
+// refresh starts a fetch unless one is running and returns it.
+func (k *JWKS) refresh() *jwksFetch {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.pending == nil {
+		k.pending = &jwksFetch{done: make(chan struct{})}
+		go k.fetch(k.pending)
+	}
+	return k.pending
+}
+
+func (k *JWKS) fetch(f *jwksFetch) {
+	keys, err := k.load()
+	k.mu.Lock()
+	k.attempted = time.Now()
+	k.err = err
+	if err == nil {
+		k.keys = keys
+		k.fetched = k.attempted
+	}
+	k.pending = nil
+	k.mu.Unlock()
+	f.err = err
+	close(f.done)
+}
+
+// load fetches the key set. Keys that cannot be used are skipped as required
+// by RFC 7517, section 5, so an unsupported key type does not break the keys
+// next to it.
+func (k *JWKS) load() (map[string]crypto.PublicKey, error) {
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := getJSON(k.Client, k.URL, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		key, err := j.publicKey()
+		if err != nil {
+			orNop(k.Logger).Log(LevelWarn, "skipping unusable key", Field{"url", k.URL}, Field{"kid", j.Kid}, Field{"error", err})
+			continue
+		}
+		keys[j.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing key in " + k.URL)
+	}
+	return keys, nil
+}
+
+// jwk is a single JSON Web Key. Only public RSA and EC keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func (j jwk) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent in jwk " + j.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q in jwk %s", j.Crv, j.Kid)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC point in jwk " + j.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q in jwk %s", j.Kty, j.Kid)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func getJSON(client *http.Client, url string, result interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Field is a key value pair attached to a log message.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the log messages of the router. The package never passes
+// token contents, credentials or response bodies of upstream services to a
+// Logger. Implementations must be safe for concurrent use.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// StdLogger writes messages of at least MinLevel to a standard library logger
+// in logfmt style, e.g.
+//     level=warn msg="key reload failed" error="open key.pem: no such file"
+type StdLogger struct {
+	Logger   *log.Logger
+	MinLevel Level
+}
+
+// NewStdLogger returns a Logger writing messages of at least minLevel to l.
+// If l is nil, the standard logger of package log is used.
+func NewStdLogger(l *log.Logger, minLevel Level) *StdLogger {
+	return &StdLogger{Logger: l, MinLevel: minLevel}
+}
+
+// Log implements the Logger interface.
+func (s *StdLogger) Log(level Level, msg string, fields ...Field) {
+	if level < s.MinLevel {
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString("level=")
+	buf.WriteString(level.String())
+	buf.WriteString(" msg=")
+	buf.WriteString(logfmtValue(msg))
+	for _, field := range fields {
+		buf.WriteByte(' ')
+		buf.WriteString(field.Key)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(fmt.Sprint(field.Value)))
+	}
+	if s.Logger != nil {
+		s.Logger.Output(2, buf.String())
+	} else {
+		log.Output(2, buf.String())
+	}
+}
+
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// nopLogger is used if no Logger is configured.
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...Field) {}
+
+// orNop returns l, or a Logger discarding all messages if l is nil.
+func orNop(l Logger) Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+	return l
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewStdLogger(log.New(&buf, "", 0), LevelInfo)
+	logger.Log(LevelDebug, "hidden")
+	logger.Log(LevelWarn, "key reload failed", Field{"error", "no such file"}, Field{"path", "/keys"})
+
+	if want := "level=warn msg=\"key reload failed\" error=\"no such file\" path=/keys\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestLoggerRedactsTokens(t *testing.T) {
+	var buf bytes.Buffer
+	key, other := newTestKey(t), newTestKey(t)
+	router := New(JwtConfig{
+		PubRsa: string(publicKeyPEM(t, key)),
+		Logger: NewStdLogger(log.New(&buf, "", 0), LevelDebug),
+	})
+	router.GET("/me", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {})
+
+	auth := signedAuth(t, other, jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "email": "alice@example.com"})
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", auth)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	out := buf.String()
+	if !strings.Contains(out, "msg=\"authentication failed\"") || !strings.Contains(out, "route=/me") {
+		t.Errorf("rejected request not logged: %q", out)
+	}
+	for _, secret := range []string{strings.Split(auth, ".")[1], "alice"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log contains token contents: %q", out)
+		}
+	}
+}
+
+func TestDecodeJWTSegmentSilent(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	var result map[string]interface{}
+	if err := DecodeJWTSegment("eyJzdWIiOiJhbGljZSI", &result); err == nil {
+		t.Error("invalid segment accepted")
+	}
+	if buf.Len() > 0 {
+		t.Errorf("payload logged: %q", buf.String())
+	}
+}
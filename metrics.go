@@ -0,0 +1,278 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the latency histogram buckets in seconds used if
+// Metrics.Buckets is empty.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects request metrics of a router and serves them in the
+// Prometheus text format. Requests are labeled by the registered route
+// pattern, e.g. "/users/:id", so the number of series is bounded by the
+// number of routes. Requests matching no route have an empty route label.
+type Metrics struct {
+	// Buckets of the latency histogram in seconds. Defaults to DefaultBuckets.
+	Buckets []float64
+
+	// TokenCache is reported if it is set, usually to the
+	// JwtConfig.TokenCache of the router.
+	TokenCache *TokenCache
+
+	mu           sync.Mutex
+	requests     map[requestLabels]uint64
+	durations    map[routeLabels]*histogram
+	inFlight     map[routeLabels]int64
+	authFailures map[string]uint64
+}
+
+type routeLabels struct {
+	method, route string
+}
+
+type requestLabels struct {
+	routeLabels
+	status int
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewMetrics returns empty metrics with the default buckets.
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) begin(method, route string) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inFlight == nil {
+		m.inFlight = map[routeLabels]int64{}
+	}
+	m.inFlight[routeLabels{method, route}]++
+	return time.Now()
+}
+
+func (m *Metrics) end(method, route string, status int, start time.Time) {
+	seconds := time.Since(start).Seconds()
+	labels := routeLabels{method, route}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[labels]--
+	if m.requests == nil {
+		m.requests = map[requestLabels]uint64{}
+		m.durations = map[routeLabels]*histogram{}
+	}
+	m.requests[requestLabels{labels, status}]++
+	h := m.durations[labels]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(m.buckets()))}
+		m.durations[labels] = h
+	}
+	for i, bound := range m.buckets() {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *Metrics) authFailure(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.authFailures == nil {
+		m.authFailures = map[string]uint64{}
+	}
+	m.authFailures[reason]++
+}
+
+func (m *Metrics) buckets() []float64 {
+	if len(m.Buckets) == 0 {
+		return DefaultBuckets
+	}
+	return m.Buckets
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out.WriteString("# HELP jwt_router_requests_total Number of handled requests.\n")
+	out.WriteString("# TYPE jwt_router_requests_total counter\n")
+	requests := make([]requestLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		requests = append(requests, labels)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].routeLabels != requests[j].routeLabels {
+			return requests[i].routeLabels.less(requests[j].routeLabels)
+		}
+		return requests[i].status < requests[j].status
+	})
+	for _, labels := range requests {
+		fmt.Fprintf(out, "jwt_router_requests_total{%s,status=\"%d\"} %d\n", labels.routeLabels, labels.status, m.requests[labels])
+	}
+
+	out.WriteString("# HELP jwt_router_request_duration_seconds Latency of handled requests.\n")
+	out.WriteString("# TYPE jwt_router_request_duration_seconds histogram\n")
+	for _, labels := range sortedRouteLabels(m.durations) {
+		h := m.durations[labels]
+		var cumulative uint64
+		for i, bound := range m.buckets() {
+			cumulative += h.counts[i]
+			fmt.Fprintf(out, "jwt_router_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(out, "jwt_router_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(out, "jwt_router_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(h.sum))
+		fmt.Fprintf(out, "jwt_router_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	out.WriteString("# HELP jwt_router_requests_in_flight Number of requests being handled.\n")
+	out.WriteString("# TYPE jwt_router_requests_in_flight gauge\n")
+	for _, labels := range sortedRouteLabels(m.inFlight) {
+		fmt.Fprintf(out, "jwt_router_requests_in_flight{%s} %d\n", labels, m.inFlight[labels])
+	}
+
+	out.WriteString("# HELP jwt_router_auth_failures_total Number of rejected authentications by reason.\n")
+	out.WriteString("# TYPE jwt_router_auth_failures_total counter\n")
+	reasons := make([]string, 0, len(m.authFailures))
+	for reason := range m.authFailures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(out, "jwt_router_auth_failures_total{reason=\"%s\"} %d\n", escapeLabel(reason), m.authFailures[reason])
+	}
+
+	if m.TokenCache != nil {
+		hits, misses := m.TokenCache.Stats()
+		out.WriteString("# HELP jwt_router_token_cache_requests_total Token cache lookups by result.\n")
+		out.WriteString("# TYPE jwt_router_token_cache_requests_total counter\n")
+		fmt.Fprintf(out, "jwt_router_token_cache_requests_total{result=\"hit\"} %d\n", hits)
+		fmt.Fprintf(out, "jwt_router_token_cache_requests_total{result=\"miss\"} %d\n", misses)
+	}
+}
+
+func (l routeLabels) String() string {
+	return "method=\"" + escapeLabel(l.method) + "\",route=\"" + escapeLabel(l.route) + "\""
+}
+
+func (l routeLabels) less(o routeLabels) bool {
+	if l.route != o.route {
+		return l.route < o.route
+	}
+	return l.method < o.method
+}
+
+func sortedRouteLabels(m interface{}) (labels []routeLabels) {
+	switch m := m.(type) {
+	case map[routeLabels]*histogram:
+		for l := range m {
+			labels = append(labels, l)
+		}
+	case map[routeLabels]int64:
+		for l := range m {
+			labels = append(labels, l)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].less(labels[j]) })
+	return
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher if the underlying writer does.
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the underlying writer does, e.g. for
+// WebSocket upgrades. Hijacked connections are counted with status 101.
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Push implements http.Pusher if the underlying writer does.
+func (w *statusRecorder) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
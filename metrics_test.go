@@ -0,0 +1,157 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestMetrics(t *testing.T) {
+	key := newTestKey(t)
+	cache := NewTokenCache()
+	router := New(JwtConfig{PubRsa: string(publicKeyPEM(t, key)), TokenCache: cache})
+	router.Metrics = &Metrics{Buckets: []float64{1, 10}, TokenCache: cache}
+	router.GET("/users/:id", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {
+		if ps.ByName("id") == "missing" {
+			http.NotFound(w, r)
+		}
+	})
+
+	auth := signedAuth(t, key, jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice"})
+	serve := func(method, path, auth string) {
+		req, _ := http.NewRequest(method, path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve("GET", "/users/1", auth)
+	serve("GET", "/users/2", auth)
+	serve("GET", "/users/missing", auth)
+	serve("GET", "/users/3", "Bearer invalid")
+	serve("GET", "/unknown", "")
+	serve("BREW", "/users/1", "")
+
+	w := httptest.NewRecorder()
+	router.Metrics.ServeHTTP(w, nil)
+	out := w.Body.String()
+	for _, line := range []string{
+		`jwt_router_requests_total{method="GET",route="/users/:id",status="200"} 2`,
+		`jwt_router_requests_total{method="GET",route="/users/:id",status="404"} 1`,
+		`jwt_router_requests_total{method="GET",route="/users/:id",status="401"} 1`,
+		`jwt_router_requests_total{method="GET",route="",status="404"} 1`,
+		`jwt_router_requests_total{method="OTHER",route="",status="405"} 1`,
+		`jwt_router_request_duration_seconds_bucket{method="GET",route="/users/:id",le="1"} 4`,
+		`jwt_router_request_duration_seconds_bucket{method="GET",route="/users/:id",le="+Inf"} 4`,
+		`jwt_router_request_duration_seconds_count{method="GET",route="/users/:id"} 4`,
+		`jwt_router_requests_in_flight{method="GET",route="/users/:id"} 0`,
+		`jwt_router_auth_failures_total{reason="invalid_credentials"} 1`,
+		`jwt_router_token_cache_requests_total{result="hit"} 2`,
+		`jwt_router_token_cache_requests_total{result="miss"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s in\n%s", line, out)
+		}
+	}
+}
+
+func TestMetricsHijack(t *testing.T) {
+	router := New(JwtConfig{})
+	router.Metrics = &Metrics{}
+	router.GET("/ws", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(status, "HTTP/1.1 101") {
+		t.Fatalf("upgrade failed: %q %v", status, err)
+	}
+
+	// the handler may still be finishing after the client got its response
+	line := `jwt_router_requests_total{method="GET",route="/ws",status="101"} 1`
+	deadline := time.Now().Add(time.Second)
+	for {
+		w := httptest.NewRecorder()
+		router.Metrics.ServeHTTP(w, nil)
+		if strings.Contains(w.Body.String(), line+"\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("missing %s in\n%s", line, w.Body.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMetricsPanic(t *testing.T) {
+	router := New(JwtConfig{})
+	router.Metrics = &Metrics{}
+	router.GET("/panic", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {
+		panic("oops")
+	})
+	router.GET("/handled", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {
+		panic("oops")
+	})
+
+	func() {
+		defer func() {
+			if recv := recover(); recv != "oops" {
+				t.Errorf("panic not passed on: %v", recv)
+			}
+		}()
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+	}()
+	router.PanicHandler = func(w http.ResponseWriter, r *http.Request, _ interface{}) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/handled", nil))
+
+	w := httptest.NewRecorder()
+	router.Metrics.ServeHTTP(w, nil)
+	for _, line := range []string{
+		`jwt_router_requests_total{method="GET",route="/panic",status="500"} 1`,
+		`jwt_router_requests_total{method="GET",route="/handled",status="503"} 1`,
+		`jwt_router_requests_in_flight{method="GET",route="/panic"} 0`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("missing %s in\n%s", line, w.Body.String())
+		}
+	}
+}
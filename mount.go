@@ -0,0 +1,165 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// mountMethods are the methods routed to mounted handlers.
+var mountMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE"}
+
+// mountParam is the catch-all parameter holding the path below a mount
+// prefix. It is not passed on to the mounted handler.
+const mountParam = "mount_path"
+
+type paramsContextKey struct{}
+type jwtContextKey struct{}
+type requestPathContextKey struct{}
+type dpopProofContextKey struct{}
+
+// ParamsFromContext returns the parameters of the prefixes a request was
+// routed through by Mount, outer prefixes first. Handlers of a mounted router
+// get their own parameters as usual.
+func ParamsFromContext(ctx context.Context) Params {
+	ps, _ := ctx.Value(paramsContextKey{}).(Params)
+	return ps
+}
+
+// JwtFromContext returns the identity the router mounting a handler
+// authenticated, see Mount. It returns false outside of mounted handlers.
+func JwtFromContext(ctx context.Context) (Jwt, bool) {
+	token, ok := ctx.Value(jwtContextKey{}).(Jwt)
+	return token, ok
+}
+
+// Mount routes all requests below prefix with the common methods to handler,
+// e.g. another Router with a JwtConfig of its own:
+//  router.Mount("/tenants/:tenant/devices", devices.Router())
+// The prefix is stripped from the request path, so "/tenants/a/devices/1"
+// reaches handler as "/1". The prefix itself is passed on as "/".
+//
+// The options apply to the requests before they reach handler, e.g. to
+// require authentication. The parameters of the prefix and the identity are
+// added to the request context, see ParamsFromContext and JwtFromContext.
+// Requests matching no route of handler are answered by handler, including
+// 404 and 405 responses. Routes registered on r below prefix take priority.
+//
+// Routes of a mounted Router are listed by Routes with their full path.
+func (r *Router) Mount(prefix string, handler http.Handler, opts ...RouteOption) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	paths := []string{prefix + "/*" + mountParam}
+	if prefix != "" {
+		paths = append(paths, prefix)
+	}
+
+	var routes []*Route
+	for _, method := range mountMethods {
+		for _, path := range paths {
+			route := newRoute(method, path, opts)
+			if route.Name != "" {
+				panic("mounts can not be named, prefix '" + prefix + "'")
+			}
+			route.Mount = prefix
+			route.mounted = handler
+			routes = append(routes, route)
+		}
+	}
+	handle := mountHandle(handler)
+	r.update(func(t *routeTable) {
+		for _, route := range routes {
+			t.add(route, handle)
+		}
+	})
+}
+
+// mountHandle passes requests on to handler with the path below the prefix.
+func mountHandle(handler http.Handler) Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps Params, token Jwt) {
+		rest := "/"
+		if n := len(ps); n > 0 && ps[n-1].Key == mountParam {
+			rest, ps = ps[n-1].Value, ps[:n-1]
+		}
+
+		ctx := req.Context()
+		parent := ParamsFromContext(ctx)
+		ctx = context.WithValue(ctx, paramsContextKey{}, mergeParams(parent, ps))
+		ctx = context.WithValue(ctx, jwtContextKey{}, token)
+		ctx = context.WithValue(ctx, requestPathContextKey{}, requestPath(req))
+		if token.dpopProof != "" {
+			// the proof passed verifyDPoP and is recorded as used by now
+			ctx = context.WithValue(ctx, dpopProofContextKey{}, token.dpopProof)
+		}
+		req = req.WithContext(ctx)
+
+		// the router matched the escaped path
+		u := *req.URL
+		u.Path, u.RawPath = rest, ""
+		if unescaped, err := url.PathUnescape(rest); err == nil && unescaped != rest {
+			u.Path, u.RawPath = unescaped, rest
+		}
+		req.URL = &u
+		handler.ServeHTTP(w, req)
+	}
+}
+
+// requestPath returns the escaped path of r as the client sent it, before
+// mounts stripped their prefixes.
+func requestPath(r *http.Request) string {
+	if path, ok := r.Context().Value(requestPathContextKey{}).(string); ok {
+		return path
+	}
+	return r.URL.EscapedPath()
+}
+
+// mountPrefix returns the escaped prefix mounts stripped from the path of r.
+func mountPrefix(r *http.Request) string {
+	path, rest := requestPath(r), r.URL.EscapedPath()
+	if strings.HasSuffix(path, rest) {
+		return path[:len(path)-len(rest)]
+	}
+	return ""
+}
+
+// mountedRoutes returns the routes of a handler mounted with route.
+func (r *Router) mountedRoutes(route *Route) []RouteInfo {
+	sub, ok := route.mounted.(*Router)
+	if !ok {
+		info := RouteInfo{Route: *route}
+		info.Method, info.Path = "*", route.Mount+"/*"
+		if info.RateLimit == nil {
+			info.RateLimit = r.RateLimit
+		}
+		info.Anonymous = r.anonymous(route)
+		return []RouteInfo{info}
+	}
+
+	routes := sub.Routes()
+	for i := range routes {
+		info := &routes[i]
+		info.Path = route.Mount + info.Path
+		info.Mount = route.Mount + info.Mount
+		if info.Host == "" {
+			info.Host = route.Host
+		}
+		info.Anonymous = info.Anonymous && r.anonymous(route)
+	}
+	return routes
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestRouterMount(t *testing.T) {
+	store := NewMemoryAPIKeyStore()
+	store.Add("s3cr3t", APIKey{Id: "key-1", UserId: "partner"})
+
+	devices := New(JwtConfig{})
+	devices.GET("/", writeHandle("list"))
+	devices.GET("/:id", func(w http.ResponseWriter, r *http.Request, ps Params, _ Jwt) {
+		token, _ := JwtFromContext(r.Context())
+		w.Write([]byte(ParamsFromContext(r.Context()).ByName("tenant") + " " + ps.ByName("id") + " " + r.URL.Path + " " + token.UserId))
+	})
+
+	router := New(JwtConfig{})
+	router.APIKeys = &APIKeyAuth{Store: store}
+	router.GET("/tenants/:tenant/devices/export", writeHandle("export"))
+	router.Mount("/tenants/:tenant/devices/", devices)
+
+	serve := func(method, path, key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		method, path, key string
+		code              int
+		body              string
+	}{
+		{"GET", "/tenants/a/devices/1", "s3cr3t", http.StatusOK, "a 1 /1 partner"},
+		{"GET", "/tenants/a/devices/1", "", http.StatusOK, "a 1 /1 "},
+		{"GET", "/tenants/a/devices", "", http.StatusOK, "list"},
+		{"GET", "/tenants/a/devices/", "", http.StatusOK, "list"},
+		{"GET", "/tenants/a/devices/export", "", http.StatusOK, "export"},
+		{"GET", "/tenants/a/devices/1/state", "", http.StatusNotFound, ""},
+		{"DELETE", "/tenants/a/devices/1", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/tenants/a/sensors/1", "", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		w := serve(test.method, test.path, test.key)
+		if w.Code != test.code {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.path, w.Code, test.code)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s %s: got %q, want %q", test.method, test.path, w.Body.String(), test.body)
+		}
+	}
+	if allow := serve("DELETE", "/tenants/a/devices/1", "").Header().Get("Allow"); !strings.Contains(allow, "GET") {
+		t.Errorf("mounted router did not answer 405 with its methods: Allow %q", allow)
+	}
+
+	// redirects of the mounted router keep the prefix
+	for path, want := range map[string]string{
+		"/tenants/a/devices/1/":  "/tenants/a/devices/1",
+		"/tenants/a/devices/./1": "/tenants/a/devices/1",
+	} {
+		if w := serve("GET", path, ""); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != want {
+			t.Errorf("%s: got %d to %q, want redirect to %q", path, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+}
+
+func TestRouterMountNested(t *testing.T) {
+	var got Params
+	leaf := New(JwtConfig{})
+	leaf.GET("/:field", func(w http.ResponseWriter, r *http.Request, ps Params, _ Jwt) {
+		got = append(ParamsFromContext(r.Context()), ps...)
+	})
+	devices := New(JwtConfig{})
+	devices.Mount("/:device/state", leaf)
+	router := New(JwtConfig{})
+	router.Mount("/tenants/:tenant", devices)
+
+	if code, _ := serveRoute(router, "", "/tenants/a/7/state/power"); code != http.StatusOK {
+		t.Fatalf("nested mount: got status %d", code)
+	}
+	want := Params{{"tenant", "a"}, {"device", "7"}, {"field", "power"}}
+	if len(got) != len(want) {
+		t.Fatalf("got params %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got params %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestRouterMountHandler(t *testing.T) {
+	router := New(JwtConfig{})
+	router.Mount("/static", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}), RequireRoles("admin"))
+
+	req := httptest.NewRequest("GET", "/static/css/a%2Fb.css", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("options of the mount not applied: got status %d", w.Code)
+	}
+
+	routes := router.Routes()
+	if len(routes) != 1 {
+		t.Fatalf("got %d routes, want 1: %+v", len(routes), routes)
+	}
+	if info := routes[0]; info.Method != "*" || info.Path != "/static/*" || info.Mount != "/static" || info.Anonymous {
+		t.Errorf("wrong route info: %+v", info)
+	}
+
+	open := New(JwtConfig{})
+	open.Mount("/static", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + " " + r.URL.EscapedPath()))
+	}))
+	if _, body := serveRoute(open, "", "/static/css/a%2Fb.css"); body != "/css/a/b.css /css/a%2Fb.css" {
+		t.Errorf("escaped path: got %q", body)
+	}
+}
+
+func TestRouterMountRoutes(t *testing.T) {
+	devices := New(JwtConfig{})
+	devices.GET("/:id", writeHandle("device"))
+	devices.PUT("/:id", writeHandle("device"), RequireRoles("admin"))
+	router := New(JwtConfig{})
+	router.GET("/health", writeHandle("ok"))
+	router.Mount("/tenants/:tenant/devices", devices)
+
+	var got []string
+	for _, info := range router.Routes() {
+		got = append(got, info.Method+" "+info.Path+" "+info.Mount)
+	}
+	want := []string{"GET /health ", "GET /tenants/:tenant/devices/:id /tenants/:tenant/devices", "PUT /tenants/:tenant/devices/:id /tenants/:tenant/devices"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got routes\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	paths := router.OpenAPI(OpenAPIInfo{})["paths"].(map[string]map[string]interface{})
+	if _, ok := paths["/tenants/{tenant}/devices/{id}"]; !ok {
+		t.Errorf("mounted route missing in OpenAPI paths: %v", paths)
+	}
+}
+
+func TestRouterMountName(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("named mount did not panic")
+		}
+	}()
+	New(JwtConfig{}).Mount("/static", http.NotFoundHandler(), Name("static"))
+}
+
+func TestRouterMountDPoP(t *testing.T) {
+	key := newTestKey(t)
+	client := newDPoPClient(t)
+	conf := JwtConfig{PubRsa: string(publicKeyPEM(t, key)), DPoP: &DPoPConfig{ReplayCache: NewMemoryReplayCache()}}
+	bound, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "alice",
+		"cnf": map[string]string{"jkt": client.thumbprint()},
+	}).SignedString(key)
+
+	for name, parentConf := range map[string]JwtConfig{"parent without dpop": {}, "parent with dpop": conf} {
+		devices := New(conf)
+		devices.GET("/:id", writeHandle("device"), RequireDPoP())
+		router := New(parentConf)
+		router.Mount("/tenants/:tenant/devices", devices)
+
+		serve := func(proof string) int {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/tenants/a/devices/1", nil)
+			req.Host = "api.example.com"
+			req.Header.Set("Authorization", "DPoP "+bound)
+			req.Header.Set("DPoP", proof)
+			router.ServeHTTP(w, req)
+			return w.Code
+		}
+		now := time.Now()
+		valid := client.proof("GET", "http://api.example.com/tenants/a/devices/1", bound, now)
+		if code := serve(valid); code != http.StatusOK {
+			t.Errorf("%s: proof for the full URL rejected: %d", name, code)
+		}
+		if code := serve(valid); code != http.StatusUnauthorized {
+			t.Errorf("%s: replayed proof accepted: %d", name, code)
+		}
+		if code := serve(client.proof("GET", "http://api.example.com/1", bound, now)); code != http.StatusUnauthorized {
+			t.Errorf("%s: proof for the stripped URL accepted: %d", name, code)
+		}
+	}
+}
+
+// claimAuthenticator trusts the cnf claim of a bearer token without checking
+// a proof.
+type claimAuthenticator struct{ jkt string }
+
+func (claimAuthenticator) Method() string { return "claim" }
+func (a claimAuthenticator) Authenticate(r *http.Request) (Jwt, bool, error) {
+	return Jwt{UserId: "alice", Confirmation: &Confirmation{JKT: a.jkt}}, true, nil
+}
+
+func TestRouterMountDPoPUnverifiedParent(t *testing.T) {
+	key := newTestKey(t)
+	client := newDPoPClient(t)
+	conf := JwtConfig{PubRsa: string(publicKeyPEM(t, key)), DPoP: &DPoPConfig{ReplayCache: NewMemoryReplayCache()}}
+	bound, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "alice",
+		"cnf": map[string]string{"jkt": client.thumbprint()},
+	}).SignedString(key)
+
+	devices := New(conf)
+	devices.GET("/devices/:id", writeHandle("device"), RequireDPoP())
+	router := New(JwtConfig{})
+	router.Authenticators = []Authenticator{claimAuthenticator{jkt: client.thumbprint()}}
+	router.Mount("/tenants/:tenant", devices)
+
+	proof := client.proof("GET", "http://api.example.com/tenants/a/devices/1", bound, time.Now())
+	serve := func() int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/tenants/a/devices/1", nil)
+		req.Host = "api.example.com"
+		req.Header.Set("Authorization", "DPoP "+bound)
+		req.Header.Set("DPoP", proof)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("proof rejected: %d", code)
+	}
+	if code := serve(); code != http.StatusUnauthorized {
+		t.Errorf("proof replayed through a parent that did not verify it: %d", code)
+	}
+}
@@ -0,0 +1,548 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package oidctest provides an in-process OpenID Connect provider for tests.
+//
+// The provider is backed by an httptest.Server and mimics the endpoints of a
+// Keycloak realm: discovery document, JWKS, token and introspection endpoint.
+// Users, clients and roles can be scripted and signing keys can be rotated on
+// demand, so router behavior can be tested end to end without network access:
+//
+//	idp := oidctest.NewProvider()
+//	defer idp.Close()
+//	idp.AddUser(oidctest.User{Username: "alice", Password: "secret", RealmRoles: []string{"user"}})
+//
+//	router := jwt_http_router.New(idp.JwtConfig())
+//	req.Header.Set("Authorization", idp.Authorization("alice"))
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/SmartEnergyPlatform/jwt-http-router"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// RealmPath is the path of the realm below the server root. The issuer of all
+// tokens is the server URL followed by RealmPath.
+const RealmPath = "/auth/realms/test"
+
+// Endpoint paths relative to the issuer.
+const (
+	DiscoveryPath     = "/.well-known/openid-configuration"
+	JWKSPath          = "/protocol/openid-connect/certs"
+	TokenPath         = "/protocol/openid-connect/token"
+	IntrospectionPath = "/protocol/openid-connect/token/introspect"
+)
+
+// GrantTypeTokenExchange is the RFC 8693 token exchange grant type.
+const GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+// User is a scriptable user of the provider.
+type User struct {
+	Id          string // used as "sub"; generated from the username if empty
+	Username    string
+	Password    string
+	RealmRoles  []string
+	ClientRoles map[string][]string    // resource_access roles by client id
+	Claims      map[string]interface{} // additional claims for every token
+}
+
+// Client is an OAuth client of the provider. Clients may use the
+// client_credentials grant, introspect tokens and exchange tokens.
+type Client struct {
+	Id         string
+	Secret     string
+	RealmRoles []string
+}
+
+type signingKey struct {
+	kid     string
+	private *rsa.PrivateKey
+}
+
+// Provider is a fake OpenID Connect provider. All methods are safe for
+// concurrent use.
+type Provider struct {
+	Server *httptest.Server
+
+	// TokenLifetime is the lifetime of issued access tokens.
+	TokenLifetime time.Duration
+
+	mu          sync.RWMutex
+	unavailable bool
+	keys        []*signingKey // keys[0] signs new tokens
+	users       map[string]*User
+	clients     map[string]*Client
+	revoked     map[string]bool
+}
+
+// NewProvider starts and returns a new provider with a single signing key,
+// no users and a client "test-client" with the secret "secret".
+func NewProvider() *Provider {
+	p := &Provider{
+		TokenLifetime: 5 * time.Minute,
+		users:         map[string]*User{},
+		clients:       map[string]*Client{},
+		revoked:       map[string]bool{},
+	}
+	p.keys = []*signingKey{newSigningKey()}
+	p.clients["test-client"] = &Client{Id: "test-client", Secret: "secret"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(RealmPath+DiscoveryPath, p.serveDiscovery)
+	mux.HandleFunc(RealmPath+JWKSPath, p.serveJWKS)
+	mux.HandleFunc(RealmPath+TokenPath, p.serveToken)
+	mux.HandleFunc(RealmPath+IntrospectionPath, p.serveIntrospection)
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.RLock()
+		unavailable := p.unavailable
+		p.mu.RUnlock()
+		if unavailable {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return p
+}
+
+// SetAvailable simulates an outage of the provider. While it is unavailable,
+// all endpoints respond with 503 Service Unavailable.
+func (p *Provider) SetAvailable(available bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.unavailable = !available
+}
+
+// Close shuts down the underlying server.
+func (p *Provider) Close() {
+	p.Server.Close()
+}
+
+// Issuer returns the issuer URL of the provider.
+func (p *Provider) Issuer() string {
+	return p.Server.URL + RealmPath
+}
+
+// JWKSURL returns the URL of the JSON Web Key Set.
+func (p *Provider) JWKSURL() string {
+	return p.Issuer() + JWKSPath
+}
+
+// TokenURL returns the URL of the token endpoint.
+func (p *Provider) TokenURL() string {
+	return p.Issuer() + TokenPath
+}
+
+// IntrospectionURL returns the URL of the token introspection endpoint.
+func (p *Provider) IntrospectionURL() string {
+	return p.Issuer() + IntrospectionPath
+}
+
+// PublicKey returns the current signing key as base64 encoded DER, the format
+// expected by JwtConfig.PubRsa.
+func (p *Provider) PublicKey() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	b, err := x509.MarshalPKIXPublicKey(&p.keys[0].private.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// KeyId returns the kid of the current signing key.
+func (p *Provider) KeyId() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.keys[0].kid
+}
+
+// JwtConfig returns a router configuration which validates tokens of this
+// provider against its JWKS, so key rotations are picked up immediately.
+func (p *Provider) JwtConfig() jwt_http_router.JwtConfig {
+	keys := jwt_http_router.NewJWKS(p.JWKSURL())
+	keys.MinRefreshInterval = 0
+	return jwt_http_router.JwtConfig{
+		Keys:       keys,
+		Issuer:     p.Issuer(),
+		Algorithms: []string{"RS256"},
+	}
+}
+
+// RotateKey creates a new signing key and returns its kid. The previous keys
+// stay published in the JWKS until RetireKeys is called, so tokens signed
+// before the rotation remain valid.
+func (p *Provider) RotateKey() string {
+	key := newSigningKey()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = append([]*signingKey{key}, p.keys...)
+	return key.kid
+}
+
+// RetireKeys removes all but the current signing key from the JWKS.
+func (p *Provider) RetireKeys() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = p.keys[:1]
+}
+
+// AddUser adds or replaces a user.
+func (p *Provider) AddUser(user User) {
+	if user.Id == "" {
+		user.Id = userId(user.Username)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.users[user.Username] = &user
+}
+
+// RemoveUser removes a user. Tokens issued before stay valid until they expire
+// or are revoked.
+func (p *Provider) RemoveUser(username string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.users, username)
+}
+
+// SetRealmRoles replaces the realm roles of a user.
+func (p *Provider) SetRealmRoles(username string, roles ...string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	user, ok := p.users[username]
+	if !ok {
+		return errors.New("unknown user " + username)
+	}
+	user.RealmRoles = roles
+	return nil
+}
+
+// AddClient adds or replaces a client.
+func (p *Provider) AddClient(client Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clients[client.Id] = &client
+}
+
+// Revoke marks a token as inactive for the introspection endpoint.
+func (p *Provider) Revoke(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.revoked[token] = true
+}
+
+// Token issues a signed access token for the given user.
+func (p *Provider) Token(username string) (string, error) {
+	return p.TokenWithClaims(username, nil)
+}
+
+// TokenWithClaims issues a signed access token for the given user with
+// additional or overriding claims.
+func (p *Provider) TokenWithClaims(username string, extra map[string]interface{}) (string, error) {
+	claims, _, ok := p.claims(username, "test-client")
+	if !ok {
+		return "", errors.New("unknown user " + username)
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return p.Sign(claims)
+}
+
+// Authorization returns an Authorization header value with a bearer token for
+// the given user. It panics if the user does not exist.
+func (p *Provider) Authorization(username string) string {
+	token, err := p.Token(username)
+	if err != nil {
+		panic(err)
+	}
+	return "Bearer " + token
+}
+
+// Sign signs arbitrary claims with the current key. Missing "iss", "iat" and
+// "exp" claims are filled in.
+func (p *Provider) Sign(claims map[string]interface{}) (string, error) {
+	now := time.Now()
+	if _, ok := claims["iss"]; !ok {
+		claims["iss"] = p.Issuer()
+	}
+	if _, ok := claims["iat"]; !ok {
+		claims["iat"] = now.Unix()
+	}
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = now.Add(p.TokenLifetime).Unix()
+	}
+	p.mu.RLock()
+	key := p.keys[0]
+	p.mu.RUnlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims(claims))
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// claims returns the claims and the password of a user. The user is read
+// under the lock because SetRealmRoles modifies it in place.
+func (p *Provider) claims(username, azp string) (claims map[string]interface{}, password string, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	user, ok := p.users[username]
+	if !ok {
+		return nil, "", false
+	}
+	return p.userClaims(user, azp), user.Password, true
+}
+
+func (p *Provider) userClaims(user *User, azp string) map[string]interface{} {
+	resourceAccess := map[string]interface{}{}
+	for client, roles := range user.ClientRoles {
+		resourceAccess[client] = map[string]interface{}{"roles": roles}
+	}
+	claims := map[string]interface{}{
+		"jti":                randomId(),
+		"sub":                user.Id,
+		"typ":                "Bearer",
+		"azp":                azp,
+		"preferred_username": user.Username,
+		"realm_access":       map[string]interface{}{"roles": roles(user.RealmRoles)},
+		"resource_access":    resourceAccess,
+	}
+	for k, v := range user.Claims {
+		claims[k] = v
+	}
+	return claims
+}
+
+func (p *Provider) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.Issuer(),
+		"jwks_uri":                              p.JWKSURL(),
+		"token_endpoint":                        p.TokenURL(),
+		"introspection_endpoint":                p.IntrospectionURL(),
+		"grant_types_supported":                 []string{"password", "client_credentials", GrantTypeTokenExchange},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+	})
+}
+
+func (p *Provider) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	keys := []map[string]interface{}{}
+	for _, key := range p.keys {
+		pub := key.private.PublicKey
+		keys = append(keys, map[string]interface{}{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": key.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+	p.mu.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+func (p *Provider) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	client, ok := p.authenticateClient(r)
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	var claims map[string]interface{}
+	switch r.PostForm.Get("grant_type") {
+	case "password":
+		var password string
+		claims, password, ok = p.claims(r.PostForm.Get("username"), client.Id)
+		if !ok || password != r.PostForm.Get("password") {
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_grant")
+			return
+		}
+	case "client_credentials":
+		claims = map[string]interface{}{
+			"jti":                randomId(),
+			"sub":                userId("service-account-" + client.Id),
+			"typ":                "Bearer",
+			"azp":                client.Id,
+			"preferred_username": "service-account-" + client.Id,
+			"realm_access":       map[string]interface{}{"roles": roles(client.RealmRoles)},
+		}
+	case GrantTypeTokenExchange:
+		subject, err := p.verify(r.PostForm.Get("subject_token"))
+		if err != nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		requested := r.PostForm.Get("requested_subject")
+		if requested == "" {
+			claims = subject
+			claims["jti"] = randomId()
+			claims["azp"] = client.Id
+			delete(claims, "iat")
+			delete(claims, "exp")
+			break
+		}
+		claims, _, ok = p.claims(requested, client.Id)
+		if !ok {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		claims["act"] = map[string]interface{}{"sub": subject["sub"]}
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	token, err := p.Sign(claims)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":      token,
+		"token_type":        "Bearer",
+		"expires_in":        int(p.TokenLifetime / time.Second),
+		"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+	})
+}
+
+func (p *Provider) serveIntrospection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if _, ok := p.authenticateClient(r); !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	token := r.PostForm.Get("token")
+	claims, err := p.verify(token)
+	p.mu.RLock()
+	revoked := p.revoked[token]
+	p.mu.RUnlock()
+	if err != nil || revoked {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"active": false})
+		return
+	}
+	claims["active"] = true
+	claims["token_type"] = "Bearer"
+	writeJSON(w, http.StatusOK, claims)
+}
+
+func (p *Provider) authenticateClient(r *http.Request) (*Client, bool) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	client, ok := p.clients[id]
+	if !ok || client.Secret != secret {
+		return nil, false
+	}
+	return client, true
+}
+
+// verify checks a token against all published keys and returns its claims.
+func (p *Provider) verify(tokenString string) (map[string]interface{}, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		for _, key := range p.keys {
+			if key.kid == kid {
+				return &key.private.PublicKey, nil
+			}
+		}
+		return nil, errors.New("unknown kid " + kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+func newSigningKey() *signingKey {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return &signingKey{kid: randomId(), private: private}
+}
+
+func randomId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// userId derives a stable, UUID formatted subject from a username.
+func userId(username string) string {
+	h := sha256.Sum256([]byte(username))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+func roles(r []string) []string {
+	if r == nil {
+		return []string{}
+	}
+	return r
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
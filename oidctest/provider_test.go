@@ -0,0 +1,233 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oidctest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SmartEnergyPlatform/jwt-http-router"
+)
+
+func postForm(t *testing.T, endpoint string, form url.Values) map[string]interface{} {
+	req, _ := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("test-client", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	result := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func getJSON(t *testing.T, endpoint string, result interface{}) {
+	resp, err := http.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProviderDiscovery(t *testing.T) {
+	idp := NewProvider()
+	defer idp.Close()
+
+	discovery := map[string]interface{}{}
+	getJSON(t, idp.Issuer()+DiscoveryPath, &discovery)
+	if discovery["issuer"] != idp.Issuer() {
+		t.Errorf("wrong issuer: %v", discovery["issuer"])
+	}
+	if discovery["jwks_uri"] != idp.JWKSURL() {
+		t.Errorf("wrong jwks_uri: %v", discovery["jwks_uri"])
+	}
+}
+
+func TestProviderKeyRotation(t *testing.T) {
+	idp := NewProvider()
+	defer idp.Close()
+
+	kids := func() (result []string) {
+		jwks := struct {
+			Keys []struct {
+				Kid string `json:"kid"`
+			} `json:"keys"`
+		}{}
+		getJSON(t, idp.JWKSURL(), &jwks)
+		for _, key := range jwks.Keys {
+			result = append(result, key.Kid)
+		}
+		return
+	}
+
+	old := idp.KeyId()
+	current := idp.RotateKey()
+	if got := kids(); !reflect.DeepEqual(got, []string{current, old}) {
+		t.Errorf("wrong keys after rotation: %v", got)
+	}
+	idp.RetireKeys()
+	if got := kids(); !reflect.DeepEqual(got, []string{current}) {
+		t.Errorf("wrong keys after retirement: %v", got)
+	}
+}
+
+func TestProviderPasswordGrantAndIntrospection(t *testing.T) {
+	idp := NewProvider()
+	defer idp.Close()
+	idp.AddUser(User{Username: "alice", Password: "secret", RealmRoles: []string{"user"}})
+
+	result := postForm(t, idp.TokenURL(), url.Values{
+		"grant_type": {"password"},
+		"username":   {"alice"},
+		"password":   {"wrong"},
+	})
+	if result["error"] != "invalid_grant" {
+		t.Errorf("wrong password accepted: %v", result)
+	}
+
+	result = postForm(t, idp.TokenURL(), url.Values{
+		"grant_type": {"password"},
+		"username":   {"alice"},
+		"password":   {"secret"},
+	})
+	token, _ := result["access_token"].(string)
+	if token == "" {
+		t.Fatalf("no access token: %v", result)
+	}
+
+	result = postForm(t, idp.IntrospectionURL(), url.Values{"token": {token}})
+	if result["active"] != true || result["preferred_username"] != "alice" {
+		t.Errorf("wrong introspection result: %v", result)
+	}
+
+	idp.Revoke(token)
+	result = postForm(t, idp.IntrospectionURL(), url.Values{"token": {token}})
+	if result["active"] != false {
+		t.Errorf("revoked token is active: %v", result)
+	}
+}
+
+func TestProviderTokenExchange(t *testing.T) {
+	idp := NewProvider()
+	defer idp.Close()
+	idp.AddUser(User{Username: "admin", RealmRoles: []string{"admin"}})
+	idp.AddUser(User{Username: "customer"})
+
+	subject, err := idp.Token("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := postForm(t, idp.TokenURL(), url.Values{
+		"grant_type":        {GrantTypeTokenExchange},
+		"subject_token":     {subject},
+		"requested_subject": {"customer"},
+	})
+	token, _ := result["access_token"].(string)
+	if token == "" {
+		t.Fatalf("no access token: %v", result)
+	}
+
+	claims, err := idp.verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != userId("customer") {
+		t.Errorf("wrong subject: %v", claims["sub"])
+	}
+	if act, _ := claims["act"].(map[string]interface{}); act["sub"] != userId("admin") {
+		t.Errorf("wrong actor: %v", claims["act"])
+	}
+}
+
+func TestProviderConcurrentRoleChanges(t *testing.T) {
+	idp := NewProvider()
+	defer idp.Close()
+	idp.AddUser(User{Username: "user", RealmRoles: []string{"user"}})
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				idp.SetRealmRoles("user", "user", "admin")
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := idp.Token("user"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func TestProviderWithRouter(t *testing.T) {
+	idp := NewProvider()
+	defer idp.Close()
+	idp.AddUser(User{Username: "alice", RealmRoles: []string{"user"}})
+
+	router := jwt_http_router.New(idp.JwtConfig())
+	var user string
+	var roles []string
+	router.GET("/me", func(w http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+		user = jwt.UserId
+		roles = jwt.RealmAccess.Roles
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", idp.Authorization("alice"))
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || user != userId("alice") || !reflect.DeepEqual(roles, []string{"user"}) {
+		t.Errorf("wrong identity: code=%d user=%q roles=%v", w.Code, user, roles)
+	}
+
+	// tokens signed with a rotated key are accepted, unknown keys are not
+	idp.RotateKey()
+	w = httptest.NewRecorder()
+	req.Header.Set("Authorization", idp.Authorization("alice"))
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("token signed with rotated key rejected: code=%d", w.Code)
+	}
+
+	router = jwt_http_router.New(jwt_http_router.JwtConfig{PubRsa: idp.PublicKey()})
+	router.GET("/me", func(w http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {})
+	idp.RotateKey()
+	w = httptest.NewRecorder()
+	req.Header.Set("Authorization", idp.Authorization("alice"))
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("token signed with unknown key accepted: code=%d", w.Code)
+	}
+}
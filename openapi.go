@@ -0,0 +1,251 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Schema is a JSON schema object (draft 2020-12) as used by OpenAPI 3.1, e.g.
+//     Schema{"type": "object", "properties": Schema{"name": Schema{"type": "string"}}}
+type Schema map[string]interface{}
+
+// Summary documents a route with a short summary.
+func Summary(summary string) RouteOption {
+	return func(route *Route) {
+		route.Summary = summary
+	}
+}
+
+// Schemas documents the JSON request body and the JSON responses by status
+// code of a route. request may be nil for routes without body.
+func Schemas(request Schema, responses map[int]Schema) RouteOption {
+	return func(route *Route) {
+		route.RequestSchema = request
+		route.ResponseSchemas = responses
+	}
+}
+
+// OpenAPIInfo is the info object of an OpenAPI document.
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// OpenAPI builds an OpenAPI 3.1 document of all registered routes without
+// Host, including the routes of mounted routers. Every authenticator of the
+// router, see Router.Authenticators, is described by a security scheme named
+// "bearer", "apiKey", "basic" or "mutualTLS"; custom authenticators are left
+// out. Bearer requirements list the scopes of a route, which OpenAPI 3.1
+// allows for http schemes. Required roles are listed in the extension
+// "x-required-roles" of an operation.
+func (r *Router) OpenAPI(info OpenAPIInfo) map[string]interface{} {
+	schemes := r.openAPISecuritySchemes()
+	paths := map[string]map[string]interface{}{}
+	for _, route := range r.Routes() {
+		if route.Host != "" || route.Method == "*" {
+			continue
+		}
+		path, params := openAPIPath(route.Path)
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(route.Method)] = openAPIOperation(route, params, schemes)
+	}
+
+	components := map[string]interface{}{}
+	for _, scheme := range schemes {
+		components[scheme.name] = scheme.scheme
+	}
+	return map[string]interface{}{
+		"openapi":    "3.1.0",
+		"info":       info,
+		"paths":      paths,
+		"components": map[string]interface{}{"securitySchemes": components},
+	}
+}
+
+// ServeOpenAPI registers a GET route at path serving the OpenAPI document of r
+// as JSON. The document is built on every request, so it includes routes
+// registered later.
+func (r *Router) ServeOpenAPI(path string, info OpenAPIInfo, opts ...RouteOption) {
+	r.GET(path, func(w http.ResponseWriter, _ *http.Request, _ Params, _ Jwt) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.OpenAPI(info))
+	}, opts...)
+}
+
+// openAPIParam is a path parameter of an operation.
+type openAPIParam struct {
+	name     string
+	schema   Schema
+	catchAll bool
+}
+
+// openAPIScheme is the security scheme of an authenticator.
+type openAPIScheme struct {
+	method string
+	name   string
+	scheme map[string]interface{}
+}
+
+// openAPISecuritySchemes describes the authenticators of r in the order they
+// are tried.
+func (r *Router) openAPISecuritySchemes() (schemes []openAPIScheme) {
+	authenticators := r.Authenticators
+	if authenticators == nil {
+		authenticators = []Authenticator{r.JwtConf}
+		if r.APIKeys != nil {
+			authenticators = append(authenticators, r.APIKeys)
+		}
+		if r.ClientCert != nil {
+			authenticators = append(authenticators, r.ClientCert)
+		}
+	}
+	described := map[string]bool{}
+	for _, a := range authenticators {
+		scheme := openAPIScheme{method: a.Method()}
+		switch a := a.(type) {
+		case JwtConfig, *JwtConfig:
+			scheme.name = "bearer"
+			scheme.scheme = map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"}
+		case *APIKeyAuth:
+			scheme.name = "apiKey"
+			scheme.scheme = map[string]interface{}{"type": "apiKey", "in": "header", "name": a.header()}
+		case *BasicAuth:
+			scheme.name = "basic"
+			scheme.scheme = map[string]interface{}{"type": "http", "scheme": "basic"}
+		case *ClientCertAuth:
+			scheme.name = "mutualTLS"
+			scheme.scheme = map[string]interface{}{"type": "mutualTLS"}
+		default:
+			continue
+		}
+		if !described[scheme.name] {
+			described[scheme.name] = true
+			schemes = append(schemes, scheme)
+		}
+	}
+	return schemes
+}
+
+func openAPIOperation(route RouteInfo, params []openAPIParam, schemes []openAPIScheme) map[string]interface{} {
+	op := map[string]interface{}{}
+	if route.Summary != "" {
+		op["summary"] = route.Summary
+	}
+	if route.Name != "" {
+		op["operationId"] = route.Name
+	}
+
+	var parameters []interface{}
+	for _, param := range params {
+		if t, ok := route.ParamTypes[param.name]; ok {
+			param.schema = t.schema()
+		}
+		parameter := map[string]interface{}{
+			"name":     param.name,
+			"in":       "path",
+			"required": true,
+			"schema":   param.schema,
+		}
+		if param.catchAll {
+			// OpenAPI path parameters are single segments
+			parameter["description"] = "The rest of the path, which may contain slashes."
+			parameter["x-catch-all"] = true
+		}
+		parameters = append(parameters, parameter)
+	}
+	if len(parameters) > 0 {
+		op["parameters"] = parameters
+	}
+
+	if route.RequestSchema != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": route.RequestSchema}},
+		}
+	}
+	responses := map[string]interface{}{}
+	for status, schema := range route.ResponseSchemas {
+		response := map[string]interface{}{"description": http.StatusText(status)}
+		if schema != nil {
+			response["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+		}
+		responses[strconv.Itoa(status)] = response
+	}
+	if len(responses) == 0 {
+		responses["200"] = map[string]interface{}{"description": http.StatusText(http.StatusOK)}
+	}
+	if _, ok := responses["400"]; !ok && len(route.ParamTypes) > 0 {
+		responses["400"] = map[string]interface{}{"description": "Invalid parameter"}
+	}
+	op["responses"] = responses
+
+	scopes := route.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+	// only bearer tokens carry scopes and confirmation keys
+	bearerOnly := len(route.Scopes) > 0 || route.DPoP || route.CertificateBound
+	var security []interface{}
+	if route.Anonymous {
+		security = append(security, map[string]interface{}{})
+	}
+	for _, scheme := range schemes {
+		if len(route.AuthMethods) > 0 && !contains(route.AuthMethods, scheme.method) {
+			continue
+		}
+		if scheme.method == AuthMethodBearer {
+			security = append(security, map[string]interface{}{scheme.name: scopes})
+		} else if !bearerOnly {
+			security = append(security, map[string]interface{}{scheme.name: []string{}})
+		}
+	}
+	op["security"] = security
+	if len(route.Roles) > 0 {
+		op["x-required-roles"] = route.Roles
+	}
+	return op
+}
+
+// openAPIPath converts a route pattern to an OpenAPI path template and
+// returns its parameters.
+func openAPIPath(pattern string) (path string, params []openAPIParam) {
+	var buf strings.Builder
+	for {
+		i := strings.IndexAny(pattern, ":*")
+		if i < 0 {
+			buf.WriteString(pattern)
+			break
+		}
+		end := i + wildcardEnd(pattern[i:])
+		key, constraint := splitWildcard(pattern[i+1 : end])
+		param := openAPIParam{name: key, schema: Schema{"type": "string"}, catchAll: pattern[i] == '*'}
+		if constraint != "" {
+			param.schema = parseConstraint(constraint).schema
+		}
+		params = append(params, param)
+		buf.WriteString(pattern[:i] + "{" + key + "}")
+		pattern = pattern[end:]
+	}
+	return buf.String(), params
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	router := New(JwtConfig{})
+	router.APIKeys = &APIKeyAuth{Store: NewMemoryAPIKeyStore()}
+	handle := func(_ http.ResponseWriter, _ *http.Request, _ Params, _ Jwt) {}
+	device := Schema{"type": "object", "properties": Schema{"name": Schema{"type": "string"}}}
+	router.GET("/devices/:id/services/*rest", handle, Name("service"), Summary("Get a service"))
+	router.POST("/devices", handle, AuthMethods(AuthMethodBearer), RequireScopes("devices:write"), RequireRoles("admin"),
+		Schemas(device, map[int]Schema{http.StatusCreated: device, http.StatusBadRequest: nil}))
+	router.ServeOpenAPI("/openapi.json", OpenAPIInfo{Title: "devices", Version: "1.0"})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	router.ServeHTTP(w, req)
+	var doc struct {
+		OpenAPI    string                            `json:"openapi"`
+		Info       OpenAPIInfo                       `json:"info"`
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components map[string]map[string]interface{} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	if doc.OpenAPI != "3.1.0" || doc.Info.Title != "devices" || len(doc.Paths) != 3 {
+		t.Fatalf("wrong document: %s", w.Body.String())
+	}
+	if _, ok := doc.Components["securitySchemes"]["apiKey"]; !ok {
+		t.Errorf("api key scheme missing: %v", doc.Components)
+	}
+
+	get := doc.Paths["/devices/{id}/services/{rest}"]["get"].(map[string]interface{})
+	if get["summary"] != "Get a service" || get["operationId"] != "service" || len(get["parameters"].([]interface{})) != 2 {
+		t.Errorf("wrong GET operation: %v", get)
+	}
+	if rest := get["parameters"].([]interface{})[1].(map[string]interface{}); rest["name"] != "rest" || rest["x-catch-all"] != true {
+		t.Errorf("catch-all parameter not marked: %v", rest)
+	}
+	wantSecurity := []interface{}{map[string]interface{}{}, map[string]interface{}{"bearer": []interface{}{}}, map[string]interface{}{"apiKey": []interface{}{}}}
+	if !reflect.DeepEqual(get["security"], wantSecurity) {
+		t.Errorf("wrong GET security: %v", get["security"])
+	}
+
+	post := doc.Paths["/devices"]["post"].(map[string]interface{})
+	if _, ok := post["requestBody"]; !ok {
+		t.Errorf("request body missing: %v", post)
+	}
+	responses := post["responses"].(map[string]interface{})
+	if _, ok := responses["201"].(map[string]interface{})["content"]; !ok || responses["400"] == nil {
+		t.Errorf("wrong responses: %v", responses)
+	}
+	wantSecurity = []interface{}{map[string]interface{}{"bearer": []interface{}{"devices:write"}}}
+	if !reflect.DeepEqual(post["security"], wantSecurity) || !reflect.DeepEqual(post["x-required-roles"], []interface{}{"admin"}) {
+		t.Errorf("wrong POST security: %v %v", post["security"], post["x-required-roles"])
+	}
+}
+
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) Method() string { return "header" }
+func (headerAuthenticator) Authenticate(r *http.Request) (Jwt, bool, error) {
+	return Jwt{}, false, nil
+}
+
+func TestOpenAPIAuthenticators(t *testing.T) {
+	router := New(JwtConfig{})
+	router.Authenticators = []Authenticator{
+		&ClientCertAuth{},
+		&BasicAuth{Store: NewMemoryAPIKeyStore()},
+		&APIKeyAuth{Store: NewMemoryAPIKeyStore(), Header: "X-Key"},
+		headerAuthenticator{},
+	}
+	handle := func(_ http.ResponseWriter, _ *http.Request, _ Params, _ Jwt) {}
+	router.GET("/any", handle)
+	router.GET("/basic", handle, AuthMethods(AuthMethodBasic, "header"))
+	router.GET("/scoped", handle, RequireScopes("read"))
+
+	doc := router.OpenAPI(OpenAPIInfo{Title: "test", Version: "1"})
+	schemes := doc["components"].(map[string]interface{})["securitySchemes"]
+	want := map[string]interface{}{
+		"mutualTLS": map[string]interface{}{"type": "mutualTLS"},
+		"basic":     map[string]interface{}{"type": "http", "scheme": "basic"},
+		"apiKey":    map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-Key"},
+	}
+	if !reflect.DeepEqual(schemes, want) {
+		t.Errorf("wrong security schemes: %v", schemes)
+	}
+
+	paths := doc["paths"].(map[string]map[string]interface{})
+	for path, want := range map[string][]interface{}{
+		"/any": {
+			map[string]interface{}{},
+			map[string]interface{}{"mutualTLS": []string{}},
+			map[string]interface{}{"basic": []string{}},
+			map[string]interface{}{"apiKey": []string{}},
+		},
+		"/basic":  {map[string]interface{}{"basic": []string{}}},
+		"/scoped": nil,
+	} {
+		if got := paths[path]["get"].(map[string]interface{})["security"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: wrong security %v", path, got)
+		}
+	}
+}
+
+func TestOpenAPIPath(t *testing.T) {
+	for pattern, want := range map[string]string{
+		"/devices/:id/services/*rest": "/devices/{id}/services/{rest}",
+		"/exports/:id.:format":        "/exports/{id}.{format}",
+		"/v:version/users/:n<int>":    "/v{version}/users/{n}",
+		"/codes/:c<[a-z/]+>/x":        "/codes/{c}/x",
+	} {
+		if path, _ := openAPIPath(pattern); path != want {
+			t.Errorf("%s: got %s, want %s", pattern, path, want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ParamType is the declared type of a path parameter, see ParamTypes.
+type ParamType string
+
+// Parameter types. Their values are converted by the Params methods of the
+// same name.
+const (
+	ParamInt   ParamType = "int"
+	ParamInt64 ParamType = "int64"
+	ParamBool  ParamType = "bool"
+	ParamUUID  ParamType = "uuid"
+	ParamTime  ParamType = "time"
+)
+
+// ErrParamMissing is the Err of a ParamError for a parameter not in Params.
+var ErrParamMissing = errors.New("missing parameter")
+
+// ParamError describes a parameter which is missing or can not be converted
+// to the requested type.
+type ParamError struct {
+	Name  string
+	Value string
+	Type  ParamType
+
+	// Err is ErrParamMissing or the error of the conversion.
+	Err error
+}
+
+func (e *ParamError) Error() string {
+	if e.Err == ErrParamMissing {
+		return "missing parameter '" + e.Name + "'"
+	}
+	return "parameter '" + e.Name + "' is not a valid " + string(e.Type) + ": '" + e.Value + "'"
+}
+
+// Unwrap returns Err.
+func (e *ParamError) Unwrap() error {
+	return e.Err
+}
+
+func (ps Params) lookup(name string, t ParamType) (string, error) {
+	for i := range ps {
+		if ps[i].Key == name {
+			return ps[i].Value, nil
+		}
+	}
+	return "", &ParamError{Name: name, Type: t, Err: ErrParamMissing}
+}
+
+// Int returns the value of the parameter name as int.
+func (ps Params) Int(name string) (int, error) {
+	v, err := ps.lookup(name, ParamInt)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, &ParamError{Name: name, Value: v, Type: ParamInt, Err: err.(*strconv.NumError).Err}
+	}
+	return i, nil
+}
+
+// Int64 returns the value of the parameter name as int64.
+func (ps Params) Int64(name string) (int64, error) {
+	v, err := ps.lookup(name, ParamInt64)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, &ParamError{Name: name, Value: v, Type: ParamInt64, Err: err.(*strconv.NumError).Err}
+	}
+	return i, nil
+}
+
+// Bool returns the value of the parameter name as bool. It accepts the
+// values of strconv.ParseBool, e.g. "true", "false", "1" and "0".
+func (ps Params) Bool(name string) (bool, error) {
+	v, err := ps.lookup(name, ParamBool)
+	if err != nil {
+		return false, err
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, &ParamError{Name: name, Value: v, Type: ParamBool, Err: err.(*strconv.NumError).Err}
+	}
+	return b, nil
+}
+
+// UUID is a parsed UUID.
+type UUID [16]byte
+
+// String formats u in the canonical lower case form.
+func (u UUID) String() string {
+	s := hex.EncodeToString(u[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// UUID returns the value of the parameter name as UUID. It accepts the form
+// 9f4e8a1c-0d2b-4a6e-8c3f-5b7d9e1a2c4f in any case.
+func (ps Params) UUID(name string) (UUID, error) {
+	var u UUID
+	v, err := ps.lookup(name, ParamUUID)
+	if err != nil {
+		return u, err
+	}
+	if !isUUID(v) {
+		return u, &ParamError{Name: name, Value: v, Type: ParamUUID, Err: errors.New("invalid UUID format")}
+	}
+	b := []byte(v[:8] + v[9:13] + v[14:18] + v[19:23] + v[24:])
+	hex.Decode(u[:], b)
+	return u, nil
+}
+
+// Time returns the value of the parameter name as time. It accepts RFC 3339
+// timestamps like 2018-02-12T13:04:05Z and dates like 2018-02-12, which are
+// midnight UTC.
+func (ps Params) Time(name string) (time.Time, error) {
+	v, err := ps.lookup(name, ParamTime)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		var dateErr error
+		if t, dateErr = time.Parse("2006-01-02", v); dateErr != nil {
+			return time.Time{}, &ParamError{Name: name, Value: v, Type: ParamTime, Err: err}
+		}
+	}
+	return t, nil
+}
+
+// check returns an error if the parameter name of ps is not of type t.
+func (t ParamType) check(ps Params, name string) (err error) {
+	switch t {
+	case ParamInt:
+		_, err = ps.Int(name)
+	case ParamInt64:
+		_, err = ps.Int64(name)
+	case ParamBool:
+		_, err = ps.Bool(name)
+	case ParamUUID:
+		_, err = ps.UUID(name)
+	case ParamTime:
+		_, err = ps.Time(name)
+	default:
+		panic("unknown parameter type '" + string(t) + "'")
+	}
+	return
+}
+
+// schema returns the OpenAPI schema of parameters of type t.
+func (t ParamType) schema() Schema {
+	switch t {
+	case ParamInt:
+		return Schema{"type": "integer"}
+	case ParamInt64:
+		return Schema{"type": "integer", "format": "int64"}
+	case ParamBool:
+		return Schema{"type": "boolean"}
+	case ParamUUID:
+		return Schema{"type": "string", "format": "uuid"}
+	case ParamTime:
+		return Schema{"type": "string", "format": "date-time"}
+	}
+	return Schema{"type": "string"}
+}
+
+// ParamTypes declares the types of path parameters of a route. Requests with
+// values not of the declared type are rejected with 400 Bad Request before
+// the handle is called, see Router.InvalidParam. Handles can then convert the
+// values with the Params methods of the type without checking the error.
+//
+// Unlike constraints, which make a route not match, the types are checked
+// after the route matched and the request was authenticated.
+func ParamTypes(types map[string]ParamType) RouteOption {
+	return func(route *Route) {
+		route.ParamTypes = make(map[string]ParamType, len(types))
+		for name, t := range types {
+			route.ParamTypes[name] = t
+		}
+	}
+}
+
+// checkParamTypes panics if host and path of route have a parameter of the
+// same name, or if route declares a type for a parameter not in its host or
+// path or an unknown type.
+func checkParamTypes(route *Route) {
+	keys := map[string]bool{}
+	for _, key := range paramKeys(hostPath(route.Host)) {
+		keys[key] = true
+	}
+	for _, key := range paramKeys(route.Path) {
+		if keys[key] {
+			panic("parameter '" + key + "' of path '" + route.Path + "' is also a parameter of host '" + route.Host + "'")
+		}
+		keys[key] = true
+	}
+	for name, t := range route.ParamTypes {
+		if !keys[name] {
+			panic("type declared for unknown parameter '" + name + "' in path '" + route.Path + "'")
+		}
+		switch t {
+		case ParamInt, ParamInt64, ParamBool, ParamUUID, ParamTime:
+		default:
+			panic("unknown type '" + string(t) + "' of parameter '" + name + "' in path '" + route.Path + "'")
+		}
+	}
+}
+
+// paramKeys returns the parameter names of a path pattern in order.
+func paramKeys(path string) (keys []string) {
+	for i := 0; i < len(path); i++ {
+		if path[i] != ':' && path[i] != '*' {
+			continue
+		}
+		end := i + wildcardEnd(path[i:])
+		key, _ := splitWildcard(path[i+1 : end])
+		keys = append(keys, key)
+		i = end - 1
+	}
+	return
+}
+
+// checkParams returns the first parameter of ps, in path order, which is not
+// of its declared type.
+func (route *Route) checkParams(ps Params) *ParamError {
+	if len(route.ParamTypes) == 0 {
+		return nil
+	}
+	for _, p := range ps {
+		if t, ok := route.ParamTypes[p.Key]; ok {
+			if err := t.check(ps, p.Key); err != nil {
+				return err.(*ParamError)
+			}
+		}
+	}
+	return nil
+}
+
+// invalidParam writes the response to a request with an invalid parameter.
+func (r *Router) invalidParam(w http.ResponseWriter, req *http.Request, err *ParamError) {
+	route, _ := RouteFromContext(req.Context())
+	orNop(r.Logger).Log(LevelInfo, "invalid parameter",
+		Field{"method", req.Method},
+		Field{"route", route.Path},
+		Field{"error", err},
+	)
+	if r.InvalidParam != nil {
+		r.InvalidParam(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":     "invalid_parameter",
+		"parameter": err.Name,
+		"type":      string(err.Type),
+		"message":   err.Error(),
+	})
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParamsAccessors(t *testing.T) {
+	ps := Params{
+		{"n", "42"},
+		{"big", "9000000000"},
+		{"flag", "true"},
+		{"id", "9F4E8A1C-0D2B-4A6E-8C3F-5B7D9E1A2C4F"},
+		{"at", "2018-02-12T13:04:05+01:00"},
+		{"day", "2018-02-12"},
+		{"bad", "x1"},
+	}
+
+	if n, err := ps.Int("n"); err != nil || n != 42 {
+		t.Errorf("Int: got %d %v", n, err)
+	}
+	if n, err := ps.Int64("big"); err != nil || n != 9000000000 {
+		t.Errorf("Int64: got %d %v", n, err)
+	}
+	if b, err := ps.Bool("flag"); err != nil || !b {
+		t.Errorf("Bool: got %v %v", b, err)
+	}
+	if u, err := ps.UUID("id"); err != nil || u.String() != "9f4e8a1c-0d2b-4a6e-8c3f-5b7d9e1a2c4f" {
+		t.Errorf("UUID: got %v %v", u, err)
+	}
+	if at, err := ps.Time("at"); err != nil || !at.Equal(time.Date(2018, 2, 12, 12, 4, 5, 0, time.UTC)) {
+		t.Errorf("Time: got %v %v", at, err)
+	}
+	if day, err := ps.Time("day"); err != nil || !day.Equal(time.Date(2018, 2, 12, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Time of date: got %v %v", day, err)
+	}
+
+	if _, err := ps.Int("missing"); !errors.Is(err, ErrParamMissing) || err.Error() != "missing parameter 'missing'" {
+		t.Errorf("missing parameter: got %v", err)
+	}
+	_, err := ps.Int("bad")
+	var perr *ParamError
+	if !errors.As(err, &perr) || perr.Name != "bad" || perr.Value != "x1" || perr.Type != ParamInt || !errors.Is(err, strconv.ErrSyntax) {
+		t.Errorf("invalid int: got %#v", err)
+	}
+	if err.Error() != "parameter 'bad' is not a valid int: 'x1'" {
+		t.Errorf("wrong message: %v", err)
+	}
+	for name, f := range map[string]func(string) error{
+		"Int64": func(n string) error { _, err := ps.Int64(n); return err },
+		"Bool":  func(n string) error { _, err := ps.Bool(n); return err },
+		"UUID":  func(n string) error { _, err := ps.UUID(n); return err },
+		"Time":  func(n string) error { _, err := ps.Time(n); return err },
+	} {
+		if err := f("bad"); err == nil {
+			t.Errorf("%s accepted 'x1'", name)
+		}
+	}
+}
+
+func TestRouterParamTypes(t *testing.T) {
+	router := New(JwtConfig{})
+	var got int
+	router.GET("/pages/:n/:at", func(_ http.ResponseWriter, _ *http.Request, ps Params, _ Jwt) {
+		got, _ = ps.Int("n")
+	}, ParamTypes(map[string]ParamType{"n": ParamInt, "at": ParamTime}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/pages/7/2018-02-12", nil))
+	if w.Code != http.StatusOK || got != 7 {
+		t.Errorf("valid parameters: got %d %d", w.Code, got)
+	}
+
+	got = 0
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/pages/seven/yesterday", nil))
+	var body map[string]string
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusBadRequest || got != 0 || body["error"] != "invalid_parameter" || body["parameter"] != "n" || body["type"] != "int" {
+		t.Errorf("invalid parameter: got %d %v", w.Code, w.Body)
+	}
+
+	router.InvalidParam = func(w http.ResponseWriter, _ *http.Request, err *ParamError) {
+		http.Error(w, err.Name, http.StatusUnprocessableEntity)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/pages/7/yesterday", nil))
+	if w.Code != http.StatusUnprocessableEntity || w.Body.String() != "at\n" {
+		t.Errorf("custom handler: got %d %q", w.Code, w.Body)
+	}
+
+	handle := func(_ http.ResponseWriter, _ *http.Request, _ Params, _ Jwt) {}
+	if recv := catchPanic(func() { router.GET("/a/:id", handle, ParamTypes(map[string]ParamType{"n": ParamInt})) }); recv == nil {
+		t.Error("no panic for type of unknown parameter")
+	}
+	if recv := catchPanic(func() { router.GET("/b/:id", handle, ParamTypes(map[string]ParamType{"id": "float"})) }); recv == nil {
+		t.Error("no panic for unknown type")
+	}
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket limit. Every key gets a bucket holding up to
+// Limit requests, which is refilled at Limit requests per Period.
+type RateLimit struct {
+	Limit  int           `json:"limit"`
+	Period time.Duration `json:"period"`
+
+	// Key selects the bucket of a request. Defaults to KeyByIdentity.
+	Key RateLimitKey `json:"-"`
+
+	// Routes with the same Group share their buckets. If Group is empty,
+	// every route has buckets of its own, also routes with the same path on
+	// different hosts.
+	Group string `json:"group,omitempty"`
+}
+
+// RateLimitKey returns the bucket key of an authenticated request. If it
+// returns an empty key, the client IP is used.
+type RateLimitKey func(r *http.Request, token Jwt) string
+
+// KeyByUser limits requests by the "sub" of the token.
+func KeyByUser(r *http.Request, token Jwt) string {
+	return token.UserId
+}
+
+// KeyByClient limits requests by the "azp" of the token.
+func KeyByClient(r *http.Request, token Jwt) string {
+	azp, _ := token.Map["azp"].(string)
+	return azp
+}
+
+// KeyByAPIKey limits requests by the id of the API key.
+func KeyByAPIKey(r *http.Request, token Jwt) string {
+	id, _ := token.Map["api_key_id"].(string)
+	return id
+}
+
+// KeyByIP limits requests by the remote address of the connection.
+// Forwarded headers are ignored.
+func KeyByIP(r *http.Request, token Jwt) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// KeyByIdentity limits requests by API key, user or client, whichever comes
+// first, and anonymous requests by client IP.
+func KeyByIdentity(r *http.Request, token Jwt) string {
+	if id := KeyByAPIKey(r, token); id != "" {
+		return "apikey:" + id
+	}
+	if sub := KeyByUser(r, token); sub != "" {
+		return "sub:" + sub
+	}
+	if azp := KeyByClient(r, token); azp != "" {
+		return "azp:" + azp
+	}
+	return ""
+}
+
+// WithRateLimit limits the requests to a route. It replaces Router.RateLimit
+// for the route.
+func WithRateLimit(limit RateLimit) RouteOption {
+	return func(route *Route) {
+		route.RateLimit = &limit
+	}
+}
+
+// RateLimitResult is the state of a bucket after a request.
+type RateLimitResult struct {
+	Allowed bool
+
+	// Remaining is the number of further requests allowed right now.
+	Remaining int
+
+	// Reset is the time until the bucket is full again, RetryAfter the time
+	// until the next request is allowed.
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// RateLimitStore holds the buckets of all keys.
+// Implementations must be safe for concurrent use.
+type RateLimitStore interface {
+	// Take takes one request from the bucket of key.
+	Take(key string, limit int, period time.Duration) RateLimitResult
+}
+
+// limit applies the rate limit of route to the request. It writes the
+// RateLimit headers and, if the limit is exceeded, a 429 response.
+func (r *Router) limit(w http.ResponseWriter, req *http.Request, route *Route, token Jwt) bool {
+	limit := r.RateLimit
+	if route != nil && route.RateLimit != nil {
+		limit = route.RateLimit
+	}
+	if limit == nil || limit.Limit <= 0 || limit.Period <= 0 {
+		return true
+	}
+
+	keyFunc := limit.Key
+	if keyFunc == nil {
+		keyFunc = KeyByIdentity
+	}
+	key := keyFunc(req, token)
+	if key == "" {
+		key = "ip:" + KeyByIP(req, token)
+	}
+	group := limit.Group
+	if group == "" && route != nil {
+		// host patterns have no '/', so host and path cannot be confused
+		group = route.Method + " " + route.Host + route.Path
+	}
+	store := r.RateLimitStore
+	if store == nil {
+		r.defaultLimitsOnce.Do(func() {
+			r.defaultLimits = NewMemoryRateLimitStore(0)
+		})
+		store = r.defaultLimits
+	}
+
+	result := store.Take(group+"\x00"+key, limit.Limit, limit.Period)
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(limit.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if result.Allowed {
+		return true
+	}
+	header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	orNop(r.Logger).Log(LevelInfo, "rate limit exceeded",
+		Field{"method", req.Method},
+		Field{"route", route.Path},
+		Field{"group", group},
+	)
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return false
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// MemoryRateLimitStore keeps the buckets in memory. Keys are spread over
+// shards with a lock each, so concurrent requests rarely contend.
+type MemoryRateLimitStore struct {
+	shards []*rateLimitShard
+}
+
+type rateLimitShard struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	period  time.Duration
+}
+
+// NewMemoryRateLimitStore returns an empty store with the given number of
+// shards. Defaults to 32 shards.
+func NewMemoryRateLimitStore(shards int) *MemoryRateLimitStore {
+	if shards <= 0 {
+		shards = 32
+	}
+	s := &MemoryRateLimitStore{shards: make([]*rateLimitShard, shards)}
+	for i := range s.shards {
+		s.shards[i] = &rateLimitShard{buckets: map[string]*bucket{}, lastSweep: time.Now()}
+	}
+	return s
+}
+
+// Take implements the RateLimitStore interface.
+func (s *MemoryRateLimitStore) Take(key string, limit int, period time.Duration) RateLimitResult {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	shard := s.shards[h.Sum32()%uint32(len(s.shards))]
+	now := time.Now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if now.Sub(shard.lastSweep) > time.Minute {
+		// full buckets behave like missing ones
+		for k, b := range shard.buckets {
+			if now.Sub(b.updated) >= b.period {
+				delete(shard.buckets, k)
+			}
+		}
+		shard.lastSweep = now
+	}
+
+	rate := float64(limit) / period.Seconds() // tokens per second
+	b, ok := shard.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit)}
+		shard.buckets[key] = b
+	} else {
+		b.tokens = math.Min(float64(limit), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	}
+	b.updated = now
+	b.period = period
+
+	result := RateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((float64(limit) - b.tokens) / rate)
+	return result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore(4)
+	for i := 2; i >= 0; i-- {
+		if result := store.Take("alice", 3, time.Hour); !result.Allowed || result.Remaining != i {
+			t.Fatalf("request %d: got %+v", 3-i, result)
+		}
+	}
+	result := store.Take("alice", 3, time.Hour)
+	if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > 20*time.Minute {
+		t.Errorf("empty bucket: got %+v", result)
+	}
+	if result := store.Take("bob", 3, time.Hour); !result.Allowed {
+		t.Error("buckets are not separated by key")
+	}
+
+	// 1000 requests per second refill quickly
+	for store.Take("fast", 1000, time.Second).Allowed {
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !store.Take("fast", 1000, time.Second).Allowed {
+		t.Error("bucket was not refilled")
+	}
+}
+
+func TestRouterRateLimit(t *testing.T) {
+	key := newTestKey(t)
+	router := New(JwtConfig{PubRsa: string(publicKeyPEM(t, key))})
+	router.RateLimitStore = NewMemoryRateLimitStore(0)
+	router.RateLimit = &RateLimit{Limit: 2, Period: time.Hour}
+	handle := func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {}
+	router.GET("/a", handle)
+	router.GET("/b", handle)
+	router.GET("/reports/:id", handle, WithRateLimit(RateLimit{Limit: 1, Period: time.Hour, Key: KeyByClient, Group: "reports"}))
+	router.POST("/reports/:id", handle, WithRateLimit(RateLimit{Limit: 1, Period: time.Hour, Key: KeyByClient, Group: "reports"}))
+
+	alice := signedAuth(t, key, jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "azp": "portal"})
+	bob := signedAuth(t, key, jwt.SigningMethodRS256, jwt.MapClaims{"sub": "bob", "azp": "portal"})
+	serve := func(method, path, auth, addr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.RemoteAddr = addr
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	serve("GET", "/a", alice, "192.0.2.1:1")
+	w := serve("GET", "/a", alice, "192.0.2.1:2")
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("wrong response within limit: %d %v", w.Code, w.Header())
+	}
+	w = serve("GET", "/a", alice, "192.0.2.1:3")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || w.Header().Get("RateLimit-Reset") == "" {
+		t.Errorf("wrong response over limit: %d %v", w.Code, w.Header())
+	}
+	if w := serve("GET", "/a", bob, "192.0.2.1:4"); w.Code != http.StatusOK {
+		t.Errorf("other user limited: %d", w.Code)
+	}
+	if w := serve("GET", "/b", alice, "192.0.2.1:5"); w.Code != http.StatusOK {
+		t.Errorf("route without group shares bucket: %d", w.Code)
+	}
+
+	// anonymous requests are limited by client IP
+	serve("GET", "/b", "", "192.0.2.2:1")
+	serve("GET", "/b", "", "192.0.2.2:2")
+	if w := serve("GET", "/b", "", "192.0.2.2:3"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("anonymous requests not limited by IP: %d", w.Code)
+	}
+	if w := serve("GET", "/b", "", "192.0.2.3:1"); w.Code != http.StatusOK {
+		t.Errorf("other IP limited: %d", w.Code)
+	}
+
+	// routes of a group share the buckets keyed by client
+	if w := serve("GET", "/reports/1", alice, "192.0.2.1:6"); w.Code != http.StatusOK {
+		t.Errorf("first report request limited: %d", w.Code)
+	}
+	if w := serve("POST", "/reports/2", bob, "192.0.2.1:7"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("group limit of client not shared: %d", w.Code)
+	}
+}
+
+func TestRouterRateLimitDefaultBuckets(t *testing.T) {
+	limit := &RateLimit{Limit: 1, Period: time.Hour}
+	first, second := New(JwtConfig{}), New(JwtConfig{})
+	for _, router := range []*Router{first, second} {
+		router.RateLimit = limit
+		router.GET("/status", writeHandle("default"))
+		router.GET("/status", writeHandle("tenant"), Host(":tenant.example.com"))
+	}
+
+	for _, test := range []struct {
+		router *Router
+		host   string
+	}{
+		{first, ""},
+		{first, "a.example.com"},
+		{second, ""},
+	} {
+		if code, _ := serveRoute(test.router, test.host, "/status"); code != http.StatusOK {
+			t.Errorf("host %q: bucket shared with another route or router: %d", test.host, code)
+		}
+	}
+	if code, _ := serveRoute(first, "", "/status"); code != http.StatusTooManyRequests {
+		t.Errorf("limit not applied: %d", code)
+	}
+}
@@ -76,6 +76,42 @@
 //   /files/templates/article.html       match: filepath="/templates/article.html"
 //   /files                              no match, but the router would redirect
 //
+// A segment can hold several parameters separated by static delimiters. The
+// name of a parameter followed by another one in its segment consists of
+// letters, digits and '_', any other character ends it. Otherwise the name
+// runs to the end of the segment, like 'user-id' in '/users/:user-id'. A
+// parameter followed by a delimiter ends at its last occurrence in the
+// segment, unless a route for the longer value matches:
+//  Path: /exports/:id.:format
+//
+//  Requests:
+//   /exports/42.csv                     match: id="42", format="csv"
+//   /exports/a.b.csv                    match: id="a.b", format="csv"
+//   /exports/42                         no match
+//
+// A named parameter can be constrained by a type or regular expression in
+// angle brackets. Values violating the constraint do not match, so the request
+// falls through to another route or 404 Not Found:
+//  Path: /devices/:id<uuid>/readings/:n<int>
+//
+//  Constraints:
+//   int, uint                           decimal integers
+//   uuid                                UUIDs like 9f4e8a1c-0d2b-4a6e-8c3f-5b7d9e1a2c4f
+//   alpha, alnum, hex                   letters, letters and digits, hex digits
+//   anything else                       a regular expression matching the whole value, e.g. :code<[A-Z]{3}>
+//
+// Static segments, named parameters and catch-all parameters may share a path
+// segment. Static segments take priority over named parameters, which take
+// priority over catch-all parameters. Constrained parameters take priority over
+// the unconstrained one. If the preferred branch does not lead to
+// a handle, the next one is tried:
+//  Paths: /users/new, /users/:id/edit, /users/*rest
+//
+//  Requests:
+//   /users/new                          match: /users/new
+//   /users/new/edit                     match: /users/:id/edit, id="new"
+//   /users/42/delete                    match: /users/*rest, rest="/42/delete"
+//
 // The value of parameters is saved as a slice of the Param struct, consisting
 // each of a key and a value. The slice is passed to the Handle func as a third
 // parameter.
@@ -89,9 +125,11 @@
 package jwt_http_router
 
 import (
-	"log"
+	"context"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // Handle is a function that can be registered to a route to handle HTTP
@@ -124,7 +162,17 @@ func (ps Params) ByName(name string) string {
 // Router is a http.Handler which can be used to dispatch requests to different
 // handler functions via configurable routes
 type Router struct {
-	trees map[string]*node
+	// mu serializes changes of the routes, requests read the table without
+	// locking
+	mu    sync.Mutex
+	table atomic.Pointer[routeTable]
+
+	// keyFiles are the JwtConfig.PubKeyFiles loaded by New, stopped by Close
+	keyFiles *KeyFiles
+
+	// defaultLimits holds the buckets if RateLimitStore is nil
+	defaultLimits     *MemoryRateLimitStore
+	defaultLimitsOnce sync.Once
 
 	// Enables automatic redirection if the current route can't be matched but a
 	// handler for the path with (without) the trailing slash exists.
@@ -175,56 +223,182 @@ type Router struct {
 	PanicHandler func(http.ResponseWriter, *http.Request, interface{})
 
 	JwtConf JwtConfig
+
+	// If set, requests without bearer token are authenticated by their API
+	// key header.
+	APIKeys *APIKeyAuth
+
+	// If set, requests without bearer token and API key are authenticated by
+	// their verified TLS client certificate.
+	ClientCert *ClientCertAuth
+
+	// Authenticators is the ordered chain of authenticators tried for every
+	// request. The first one recognizing the credentials decides about
+	// success or failure. If it is nil, the chain is JwtConf, APIKeys and
+	// ClientCert.
+	Authenticators []Authenticator
+
+	// If Audit is set, every authentication decision is sent to it as an
+	// AuditEvent, including successful and anonymous requests. Set it when
+	// enabling JwtConfig.ImpersonationHeader to record who acted as whom.
+	Audit AuditSink
+
+	// Logger receives rejected requests at info level. If it is nil, nothing
+	// is logged. New sets it to JwtConfig.Logger.
+	Logger Logger
+
+	// RateLimit limits the requests to all routes without a limit of their
+	// own. Requests are counted after authentication, so limits can be keyed
+	// by identity.
+	RateLimit *RateLimit
+
+	// RateLimitStore holds the buckets of all rate limits. If it is nil, the
+	// router keeps them in memory of its own.
+	RateLimitStore RateLimitStore
+
+	// If Metrics is set, all requests are counted and timed. Serve it on a
+	// separate route or port to expose the metrics.
+	Metrics *Metrics
+
+	// If Tracer is set, a span named by the method and route pattern is
+	// started for every routed request. Without Tracer the incoming W3C trace
+	// context is still passed on, see TraceFromContext.
+	Tracer Tracer
+
+	// Function to handle requests with a parameter not of the type declared
+	// with ParamTypes. If it is not set, a JSON body describing the error is
+	// sent with http.StatusBadRequest.
+	InvalidParam func(http.ResponseWriter, *http.Request, *ParamError)
 }
 
+// Route is a registered route. Routes are shared by all requests and must
+// not be modified after registration.
+type Route struct {
+	// Name identifies the route for Router.URL, see Name.
+	Name string `json:"name,omitempty"`
+
+	Method string `json:"method"`
+
+	// Path is the registered pattern, e.g. "/devices/:id/services/*rest".
+	Path string `json:"path"`
+
+	// Host is the host pattern of the route, see Host.
+	Host string `json:"host,omitempty"`
+
+	// AuthMethods accepted by the route. Empty accepts all methods and
+	// anonymous requests.
+	AuthMethods []string `json:"auth_methods,omitempty"`
+
+	// DPoP requires DPoP bound bearer tokens.
+	DPoP bool `json:"dpop,omitempty"`
+
+	// CertificateBound requires bearer tokens bound to the TLS client
+	// certificate.
+	CertificateBound bool `json:"certificate_bound,omitempty"`
+
+	// Roles are the realm roles of which an identity needs at least one,
+	// Scopes the scopes a token needs all of.
+	Roles  []string `json:"roles,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+
+	// RateLimit limits the requests to the route, see WithRateLimit.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+
+	// ParamTypes are the declared types of path parameters, see ParamTypes.
+	ParamTypes map[string]ParamType `json:"param_types,omitempty"`
+
+	// Mount is the prefix the route was mounted at, see Mount.
+	Mount string `json:"mount,omitempty"`
+
+	// the handler mounted with the route
+	mounted http.Handler
+
+	// Summary, RequestSchema and ResponseSchemas document the route in the
+	// OpenAPI document of the router, see Summary and Schemas.
+	Summary         string         `json:"summary,omitempty"`
+	RequestSchema   Schema         `json:"-"`
+	ResponseSchemas map[int]Schema `json:"-"`
+}
+
+type routeContextKey struct{}
+
+// RouteFromContext returns the route matched by the router for the request
+// with the context ctx. Handlers registered with Handle or Handler get it
+// from the request context.
+func RouteFromContext(ctx context.Context) (*Route, bool) {
+	route, ok := ctx.Value(routeContextKey{}).(*Route)
+	return route, ok
+}
+
+// RouteOption configures a Route at registration.
+type RouteOption func(*Route)
+
 // Make sure the Router conforms with the http.Handler interface
 var _ http.Handler = New(JwtConfig{})
 
 // New returns a new initialized Router.
 // Path auto-correction, including trailing slashes, is enabled by default.
+// Invalid keys in conf do not make New fail; they are logged or reject the
+// tokens of every request. If conf has PubKeyFiles, call Close to stop
+// watching them.
 func New(conf JwtConfig) *Router {
-	return &Router{
+	router := &Router{
 		RedirectTrailingSlash:  true,
 		RedirectFixedPath:      true,
 		HandleMethodNotAllowed: true,
 		HandleOPTIONS:          true,
 		JwtConf:                conf,
+		Logger:                 conf.Logger,
+	}
+	if conf.Keys == nil && len(conf.PubKeyFiles) > 0 {
+		router.keyFiles = conf.keyFiles()
+		router.JwtConf.Keys = router.keyFiles
+	}
+	return router
+}
+
+// Close stops watching the JwtConfig.PubKeyFiles loaded by New. Key sources
+// passed in JwtConfig.Keys are left to their owner. The router keeps the last
+// loaded keys and can still serve requests.
+func (r *Router) Close() {
+	if r.keyFiles != nil {
+		r.keyFiles.Close()
 	}
 }
 
 // GET is a shortcut for router.Handle("GET", path, handle)
-func (r *Router) GET(path string, handle Handle) {
-	r.Handle("GET", path, handle)
+func (r *Router) GET(path string, handle Handle, opts ...RouteOption) {
+	r.Handle("GET", path, handle, opts...)
 }
 
 // HEAD is a shortcut for router.Handle("HEAD", path, handle)
-func (r *Router) HEAD(path string, handle Handle) {
-	r.Handle("HEAD", path, handle)
+func (r *Router) HEAD(path string, handle Handle, opts ...RouteOption) {
+	r.Handle("HEAD", path, handle, opts...)
 }
 
 // OPTIONS is a shortcut for router.Handle("OPTIONS", path, handle)
-func (r *Router) OPTIONS(path string, handle Handle) {
-	r.Handle("OPTIONS", path, handle)
+func (r *Router) OPTIONS(path string, handle Handle, opts ...RouteOption) {
+	r.Handle("OPTIONS", path, handle, opts...)
 }
 
 // POST is a shortcut for router.Handle("POST", path, handle)
-func (r *Router) POST(path string, handle Handle) {
-	r.Handle("POST", path, handle)
+func (r *Router) POST(path string, handle Handle, opts ...RouteOption) {
+	r.Handle("POST", path, handle, opts...)
 }
 
 // PUT is a shortcut for router.Handle("PUT", path, handle)
-func (r *Router) PUT(path string, handle Handle) {
-	r.Handle("PUT", path, handle)
+func (r *Router) PUT(path string, handle Handle, opts ...RouteOption) {
+	r.Handle("PUT", path, handle, opts...)
 }
 
 // PATCH is a shortcut for router.Handle("PATCH", path, handle)
-func (r *Router) PATCH(path string, handle Handle) {
-	r.Handle("PATCH", path, handle)
+func (r *Router) PATCH(path string, handle Handle, opts ...RouteOption) {
+	r.Handle("PATCH", path, handle, opts...)
 }
 
 // DELETE is a shortcut for router.Handle("DELETE", path, handle)
-func (r *Router) DELETE(path string, handle Handle) {
-	r.Handle("DELETE", path, handle)
+func (r *Router) DELETE(path string, handle Handle, opts ...RouteOption) {
+	r.Handle("DELETE", path, handle, opts...)
 }
 
 // Handle registers a new request handle with the given path and method.
@@ -235,38 +409,49 @@ func (r *Router) DELETE(path string, handle Handle) {
 // This function is intended for bulk loading and to allow the usage of less
 // frequently used, non-standardized or custom methods (e.g. for internal
 // communication with a proxy).
-func (r *Router) Handle(method, path string, handle Handle) {
-	if path[0] != '/' {
-		panic("path must begin with '/' in path '" + path + "'")
-	}
+//
+// The options configure per-route behavior such as the accepted
+// authentication methods.
+//
+// Handle is safe for concurrent use with ServeHTTP, so routes can be added
+// while serving, see also Replace and Remove. If it panics, the routes are
+// not changed.
+func (r *Router) Handle(method, path string, handle Handle, opts ...RouteOption) {
+	route := newRoute(method, path, opts)
+	r.update(func(t *routeTable) {
+		t.add(route, handle)
+	})
+}
 
-	if r.trees == nil {
-		r.trees = make(map[string]*node)
+// newRoute applies opts to a new route and checks it.
+func newRoute(method, path string, opts []RouteOption) *Route {
+	if path == "" || path[0] != '/' {
+		panic("path must begin with '/' in path '" + path + "'")
 	}
 
-	root := r.trees[method]
-	if root == nil {
-		root = new(node)
-		r.trees[method] = root
+	route := &Route{Method: method, Path: path}
+	for _, opt := range opts {
+		opt(route)
 	}
-
-	root.addRoute(path, handle)
+	checkParamTypes(route)
+	return route
 }
 
 // Handler is an adapter which allows the usage of an http.Handler as a
 // request handle.
-func (r *Router) Handler(method, path string, handler http.Handler) {
+func (r *Router) Handler(method, path string, handler http.Handler, opts ...RouteOption) {
 	r.Handle(method, path,
 		func(w http.ResponseWriter, req *http.Request, _ Params, _ Jwt) {
 			handler.ServeHTTP(w, req)
 		},
+		opts...,
 	)
 }
 
 // HandlerFunc is an adapter which allows the usage of an http.HandlerFunc as a
 // request handle.
-func (r *Router) HandlerFunc(method, path string, handler http.HandlerFunc) {
-	r.Handler(method, path, handler)
+func (r *Router) HandlerFunc(method, path string, handler http.HandlerFunc, opts ...RouteOption) {
+	r.Handler(method, path, handler, opts...)
 }
 
 // ServeFiles serves files from the given file system root.
@@ -292,6 +477,22 @@ func (r *Router) ServeFiles(path string, root http.FileSystem) {
 	})
 }
 
+// metricsLabels returns the method and route pattern a request is counted
+// by, given the tree of its method and the leaf it matched. Methods without
+// routes are counted as "OTHER", so clients cannot create arbitrary series.
+func metricsLabels(method string, root, leaf *node) (string, string) {
+	if root == nil {
+		if method != "OPTIONS" {
+			method = "OTHER"
+		}
+		return method, ""
+	}
+	if leaf != nil && leaf.route != nil {
+		return method, leaf.route.Path
+	}
+	return method, ""
+}
+
 func (r *Router) recv(w http.ResponseWriter, req *http.Request) {
 	if rcv := recover(); rcv != nil {
 		r.PanicHandler(w, req, rcv)
@@ -300,19 +501,33 @@ func (r *Router) recv(w http.ResponseWriter, req *http.Request) {
 
 // Lookup allows the manual lookup of a method + path combo.
 // This is e.g. useful to build a framework around this router.
+// Only routes without Host are looked up.
 // If the path was found, it returns the handle function and the path parameter
 // values. Otherwise the third return value indicates whether a redirection to
 // the same path with an extra / without the trailing slash should be performed.
 func (r *Router) Lookup(method, path string) (Handle, Params, bool) {
-	if root := r.trees[method]; root != nil {
+	if root := r.loadTable().trees[method]; root != nil {
 		return root.getValue(path)
 	}
 	return nil, nil, false
 }
 
-func (r *Router) allowed(path, reqMethod string) (allow string) {
+// LookupRoute is like Lookup but returns the matched Route instead of the
+// handle.
+func (r *Router) LookupRoute(method, path string) (*Route, Params, bool) {
+	if root := r.loadTable().trees[method]; root != nil {
+		leaf, ps, tsr := root.getLeaf(path)
+		if leaf == nil {
+			return nil, nil, tsr
+		}
+		return leaf.route, ps, false
+	}
+	return nil, nil, false
+}
+
+func (r *Router) allowed(trees map[string]*node, path, reqMethod string) (allow string) {
 	if path == "*" { // server-wide
-		for method := range r.trees {
+		for method := range trees {
 			if method == "OPTIONS" {
 				continue
 			}
@@ -325,13 +540,13 @@ func (r *Router) allowed(path, reqMethod string) (allow string) {
 			}
 		}
 	} else { // specific path
-		for method := range r.trees {
+		for method := range trees {
 			// Skip the requested method - we already tried this one
 			if method == reqMethod || method == "OPTIONS" {
 				continue
 			}
 
-			handle, _, _ := r.trees[method].getValue(path)
+			handle, _, _ := trees[method].getValue(path)
 			if handle != nil {
 				// add request method to list of allowed methods
 				if len(allow) == 0 {
@@ -350,20 +565,75 @@ func (r *Router) allowed(path, reqMethod string) (allow string) {
 
 // ServeHTTP makes the router implement the http.Handler interface.
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Split(req.URL.String(), "?")[0]
+	trees, hostParams := r.loadTable().treesFor(req.Host)
+
+	root := trees[req.Method]
+	var leaf *node
+	var ps Params
+	var tsr bool
+	if root != nil {
+		leaf, ps, tsr = root.getLeaf(path)
+	}
+
+	if r.Metrics != nil {
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		method, pattern := metricsLabels(req.Method, root, leaf)
+		start := r.Metrics.begin(method, pattern)
+		defer func() {
+			if v := recover(); v != nil {
+				// without PanicHandler, net/http aborts the response
+				r.Metrics.end(method, pattern, http.StatusInternalServerError, start)
+				panic(v)
+			}
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			r.Metrics.end(method, pattern, rec.status, start)
+		}()
+	}
+
 	if r.PanicHandler != nil {
 		defer r.recv(w, req)
 	}
 
-	path := strings.Split(req.URL.String(), "?")[0]
-
-	if root := r.trees[req.Method]; root != nil {
-		if handle, ps, tsr := root.getValue(path); handle != nil {
+	if root != nil {
+		if leaf != nil {
+			ps = mergeParams(hostParams, ps)
+			req = req.WithContext(context.WithValue(req.Context(), routeContextKey{}, leaf.route))
+			req, span := r.startSpan(req, leaf.route)
+			defer span.End()
 			token, err := r.jwt(req)
+			token.Impersonate.trace, _ = TraceFromContext(req.Context())
+			if err == nil {
+				err = leaf.route.authorize(token)
+			}
+			traceAuth(span, token, err)
+			r.audit(req, leaf.route, token, err)
 			if err == nil {
-				handle(w, req, ps, token)
+				if r.limit(w, req, leaf.route, token) {
+					if err := leaf.route.checkParams(ps); err != nil {
+						r.invalidParam(w, req, err)
+					} else {
+						leaf.handle(w, req, ps, token)
+					}
+				}
 			} else {
-				log.Println("error in jwt: ", err)
-				http.Error(w, err.Error(), http.StatusUnauthorized)
+				if r.Metrics != nil {
+					r.Metrics.authFailure(auditReason(err))
+				}
+				orNop(r.Logger).Log(LevelInfo, "authentication failed",
+					Field{"method", req.Method},
+					Field{"route", leaf.route.Path},
+					Field{"reason", auditReason(err)},
+					Field{"error", err},
+				)
+				code := http.StatusUnauthorized
+				if err == ErrInsufficientRoles {
+					code = http.StatusForbidden
+				}
+				http.Error(w, err.Error(), code)
 			}
 			return
 		} else if req.Method != "CONNECT" && path != "/" {
@@ -374,11 +644,14 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				code = 307
 			}
 
+			// mounted routers redirect to the path the client sent
+			prefix := mountPrefix(req)
+
 			if tsr && r.RedirectTrailingSlash {
 				if len(path) > 1 && path[len(path)-1] == '/' {
-					req.URL.Path = path[:len(path)-1]
+					req.URL.Path = prefix + path[:len(path)-1]
 				} else {
-					req.URL.Path = path + "/"
+					req.URL.Path = prefix + path + "/"
 				}
 				http.Redirect(w, req, req.URL.String(), code)
 				return
@@ -391,7 +664,7 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 					r.RedirectTrailingSlash,
 				)
 				if found {
-					req.URL.Path = string(fixedPath)
+					req.URL.Path = prefix + string(fixedPath)
 					http.Redirect(w, req, req.URL.String(), code)
 					return
 				}
@@ -402,7 +675,7 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.Method == "OPTIONS" {
 		// Handle OPTIONS requests
 		if r.HandleOPTIONS {
-			if allow := r.allowed(path, req.Method); len(allow) > 0 {
+			if allow := r.allowed(trees, path, req.Method); len(allow) > 0 {
 				w.Header().Set("Allow", allow)
 				return
 			}
@@ -410,7 +683,7 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	} else {
 		// Handle 405
 		if r.HandleMethodNotAllowed {
-			if allow := r.allowed(path, req.Method); len(allow) > 0 {
+			if allow := r.allowed(trees, path, req.Method); len(allow) > 0 {
 				w.Header().Set("Allow", allow)
 				if r.MethodNotAllowed != nil {
 					r.MethodNotAllowed.ServeHTTP(w, req)
@@ -109,7 +109,7 @@ func TestRouterWithQuery(t *testing.T) {
 	router.Handle("GET", "/query", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {
 		routed = true
 		if r.URL.Query().Get("field") != "value" {
-			t.Fatalf("wrong query parameter value "+r.URL.Query().Get("field"))
+			t.Fatalf("wrong query parameter value %s", r.URL.Query().Get("field"))
 		}
 	})
 
@@ -556,6 +556,40 @@ func TestRouterLookup(t *testing.T) {
 	}
 }
 
+func TestRouterRouteFromContext(t *testing.T) {
+	router := New(JwtConfig{})
+	var handlePattern, handlerPattern string
+	router.GET("/devices/:id/services/*rest", func(_ http.ResponseWriter, r *http.Request, _ Params, _ Jwt) {
+		if route, ok := RouteFromContext(r.Context()); ok {
+			handlePattern = route.Path
+		}
+	})
+	router.HandlerFunc("POST", "/devices/:id", func(_ http.ResponseWriter, r *http.Request) {
+		if route, ok := RouteFromContext(r.Context()); ok {
+			handlerPattern = route.Method + " " + route.Path
+		}
+	})
+
+	req, _ := http.NewRequest("GET", "/devices/1/services/a/b", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if handlePattern != "/devices/:id/services/*rest" {
+		t.Errorf("wrong pattern for handle: %q", handlePattern)
+	}
+	req, _ = http.NewRequest("POST", "/devices/1", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if handlerPattern != "POST /devices/:id" {
+		t.Errorf("wrong pattern for handler: %q", handlerPattern)
+	}
+
+	route, params, _ := router.LookupRoute("GET", "/devices/2/services/x")
+	if route == nil || route.Path != "/devices/:id/services/*rest" || params.ByName("id") != "2" {
+		t.Errorf("wrong lookup: %+v %v", route, params)
+	}
+	if route, _, tsr := router.LookupRoute("POST", "/devices/2/"); route != nil || !tsr {
+		t.Errorf("wrong lookup of path with trailing slash: %+v %v", route, tsr)
+	}
+}
+
 type mockFileSystem struct {
 	opened bool
 }
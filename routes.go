@@ -0,0 +1,126 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// RouteInfo describes a registered route with the policy the router applies
+// to it.
+type RouteInfo struct {
+	Route
+
+	// Anonymous reports whether requests without credentials reach the
+	// handle.
+	Anonymous bool `json:"anonymous"`
+}
+
+// Routes returns all registered routes ordered by host, path and method.
+// RateLimit is the limit in effect, which may be Router.RateLimit. Mounted
+// routers contribute their routes, other mounted handlers a route with the
+// method "*".
+func (r *Router) Routes() []RouteInfo {
+	var routes []RouteInfo
+	table := r.loadTable()
+	roots := make([]*node, 0, len(table.trees))
+	for _, root := range table.trees {
+		roots = append(roots, root)
+	}
+	for _, trees := range table.hostTrees {
+		for _, root := range trees {
+			roots = append(roots, root)
+		}
+	}
+	mounts := map[string]bool{}
+	for _, root := range roots {
+		root.walk(func(n *node) {
+			if n.route == nil {
+				return
+			}
+			if n.route.mounted != nil {
+				// every mount has routes for several methods and paths
+				if key := n.route.Host + " " + n.route.Mount; !mounts[key] {
+					mounts[key] = true
+					routes = append(routes, r.mountedRoutes(n.route)...)
+				}
+				return
+			}
+			info := RouteInfo{Route: *n.route}
+			if info.RateLimit == nil {
+				info.RateLimit = r.RateLimit
+			}
+			info.Anonymous = r.anonymous(n.route)
+			routes = append(routes, info)
+		})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Host != routes[j].Host {
+			return routes[i].Host < routes[j].Host
+		}
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
+
+// anonymous reports whether requests without credentials pass the policy of
+// route.
+func (r *Router) anonymous(route *Route) bool {
+	return !r.JwtConf.ForceAuth && len(route.AuthMethods) == 0 && len(route.Roles) == 0 && len(route.Scopes) == 0 && !route.DPoP && !route.CertificateBound
+}
+
+// Walk calls fn for every route in the order of Routes. It stops at the first
+// error and returns it.
+func (r *Router) Walk(fn func(route RouteInfo) error) error {
+	for _, route := range r.Routes() {
+		if err := fn(route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RoutesHandler returns a handle serving the routes of r as JSON to users with
+// one of the given realm roles, e.g.
+//     router.GET("/debug/routes", router.RoutesHandler("admin"))
+// Other requests get 403 Forbidden.
+func (r *Router) RoutesHandler(roles ...string) Handle {
+	if len(roles) == 0 {
+		panic("the routes handler needs at least one role")
+	}
+	return func(w http.ResponseWriter, req *http.Request, _ Params, token Jwt) {
+		if !token.hasAnyRealmRole(roles) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Routes())
+	}
+}
+
+// walk calls fn for n and all its descendants.
+func (n *node) walk(fn func(*node)) {
+	fn(n)
+	for _, child := range n.children {
+		child.walk(fn)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestRouterRoutes(t *testing.T) {
+	key := newTestKey(t)
+	router := New(JwtConfig{PubRsa: string(publicKeyPEM(t, key))})
+	router.RateLimit = &RateLimit{Limit: 10, Period: time.Minute}
+	handle := func(_ http.ResponseWriter, _ *http.Request, _ Params, _ Jwt) {}
+	router.GET("/users/:id", handle, Name("user"), AuthMethods(AuthMethodBearer))
+	router.POST("/users", handle, RequireDPoP())
+	router.GET("/health", handle, WithRateLimit(RateLimit{Limit: 100, Period: time.Second}))
+	router.GET("/debug/routes", router.RoutesHandler("admin"))
+
+	routes := router.Routes()
+	want := []struct {
+		method, path, name string
+		anonymous          bool
+		limit              int
+	}{
+		{"GET", "/debug/routes", "", true, 10},
+		{"GET", "/health", "", true, 100},
+		{"POST", "/users", "", false, 10},
+		{"GET", "/users/:id", "user", false, 10},
+	}
+	if len(routes) != len(want) {
+		t.Fatalf("got %d routes, want %d", len(routes), len(want))
+	}
+	for i, route := range routes {
+		w := want[i]
+		if route.Method != w.method || route.Path != w.path || route.Name != w.name || route.Anonymous != w.anonymous || route.RateLimit.Limit != w.limit {
+			t.Errorf("route %d: got %+v, want %+v", i, route, w)
+		}
+	}
+
+	var visited int
+	stop := errors.New("stop")
+	if err := router.Walk(func(route RouteInfo) error {
+		if visited++; route.Path == "/health" {
+			return stop
+		}
+		return nil
+	}); err != stop || visited != 2 {
+		t.Errorf("walk did not stop: %v after %d routes", err, visited)
+	}
+
+	serve := func(roles ...interface{}) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/debug/routes", nil)
+		req.Header.Set("Authorization", signedAuth(t, key, jwt.SigningMethodRS256, jwt.MapClaims{
+			"sub":          "alice",
+			"realm_access": map[string]interface{}{"roles": roles},
+		}))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	if w := serve("user"); w.Code != http.StatusForbidden {
+		t.Errorf("route table served to non-admin: %d", w.Code)
+	}
+	w := serve("admin")
+	var served []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || len(served) != 4 {
+		t.Fatalf("wrong route table: %v %s", err, w.Body.String())
+	}
+	if served[3]["name"] != "user" || served[3]["path"] != "/users/:id" || served[2]["dpop"] != true {
+		t.Errorf("wrong route table: %s", w.Body.String())
+	}
+}
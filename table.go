@@ -0,0 +1,197 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"net/http"
+	"strings"
+)
+
+// routeTable holds the routes of a router. A published table is never
+// modified: changes are made to a copy, which then replaces the table
+// atomically. Requests therefore always see a consistent set of routes
+// without locking.
+type routeTable struct {
+	trees map[string]*node
+
+	// tree of the host patterns and the method trees by host pattern
+	hosts     *node
+	hostTrees map[string]map[string]*node
+
+	names map[string]*Route
+}
+
+var emptyTable = &routeTable{}
+
+// loadTable returns the current route table.
+func (r *Router) loadTable() *routeTable {
+	if t := r.table.Load(); t != nil {
+		return t
+	}
+	return emptyTable
+}
+
+// update applies fn to a copy of the route table and publishes the copy. If
+// fn panics, the table is not changed.
+func (r *Router) update(fn func(t *routeTable)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.loadTable().clone()
+	fn(t)
+	r.table.Store(t)
+}
+
+// clone copies the maps of t. Trees are shared until they are modified.
+func (t *routeTable) clone() *routeTable {
+	c := &routeTable{
+		trees:     make(map[string]*node, len(t.trees)),
+		hosts:     t.hosts,
+		hostTrees: make(map[string]map[string]*node, len(t.hostTrees)),
+		names:     make(map[string]*Route, len(t.names)),
+	}
+	for method, root := range t.trees {
+		c.trees[method] = root
+	}
+	for pattern, trees := range t.hostTrees {
+		c.hostTrees[pattern] = trees
+	}
+	for name, route := range t.names {
+		c.names[name] = route
+	}
+	return c
+}
+
+// methodTrees returns the method trees of the routes for the host pattern to
+// be modified, adding the host pattern if necessary.
+func (t *routeTable) methodTrees(pattern string) map[string]*node {
+	if pattern == "" {
+		return t.trees
+	}
+
+	if shared, ok := t.hostTrees[pattern]; ok {
+		trees := make(map[string]*node, len(shared))
+		for method, root := range shared {
+			trees[method] = root
+		}
+		t.hostTrees[pattern] = trees
+		return trees
+	}
+
+	if strings.ContainsAny(pattern, "/*") {
+		panic("host pattern must not contain '/' or catch-all parameters in host '" + pattern + "'")
+	}
+	hosts := new(node)
+	if t.hosts != nil {
+		hosts = t.hosts.copy()
+	}
+	// host leaves need a handle to be matched, it is never called
+	leaf := hosts.addRoute(hostPath(pattern), func(http.ResponseWriter, *http.Request, Params, Jwt) {})
+	leaf.route = &Route{Host: pattern}
+	t.hosts = hosts
+	trees := make(map[string]*node)
+	t.hostTrees[pattern] = trees
+	return trees
+}
+
+// add registers route with handle.
+func (t *routeTable) add(route *Route, handle Handle) {
+	if route.Name != "" {
+		if _, ok := t.names[route.Name]; ok {
+			panic("a route named '" + route.Name + "' is already registered, path '" + route.Path + "'")
+		}
+	}
+
+	trees := t.methodTrees(route.Host)
+	root := new(node)
+	if trees[route.Method] != nil {
+		root = trees[route.Method].copy()
+	}
+	root.addRoute(route.Path, handle).route = route
+	trees[route.Method] = root
+
+	if route.Name != "" {
+		t.names[route.Name] = route
+	}
+}
+
+// remove removes the route registered with method, host pattern and path. It
+// returns the removed route or nil if there is none.
+func (t *routeTable) remove(method, host, path string) *Route {
+	if _, ok := t.hostTrees[host]; host != "" && !ok {
+		return nil
+	}
+	trees := t.methodTrees(host)
+	root := trees[method]
+	if root == nil {
+		return nil
+	}
+	leaf := root.find(path)
+	if leaf == nil {
+		return nil
+	}
+
+	if root = root.without(path); root != nil {
+		trees[method] = root
+	} else {
+		delete(trees, method)
+	}
+	if leaf.route.Name != "" {
+		delete(t.names, leaf.route.Name)
+	}
+
+	// hosts without routes are unknown again
+	if host != "" && len(trees) == 0 {
+		delete(t.hostTrees, host)
+		t.hosts = t.hosts.without(hostPath(host))
+	}
+	return leaf.route
+}
+
+// Replace replaces the handle and options of the route registered with method
+// and path, and with the host given by opts. It reports whether such a route
+// was registered; if not, nothing is changed.
+//
+// Like Handle and Remove, Replace is safe for concurrent use with ServeHTTP.
+// Requests see the routes either before or after the replacement.
+func (r *Router) Replace(method, path string, handle Handle, opts ...RouteOption) (replaced bool) {
+	route := newRoute(method, path, opts)
+	r.update(func(t *routeTable) {
+		if t.remove(method, route.Host, path) == nil {
+			return
+		}
+		t.add(route, handle)
+		replaced = true
+	})
+	return
+}
+
+// Remove removes the route registered with method and path, and with the host
+// given by opts. Other options are ignored. It reports whether such a route
+// was registered.
+//
+// Remove is safe for concurrent use with ServeHTTP. Requests being handled
+// by the removed route are not interrupted.
+func (r *Router) Remove(method, path string, opts ...RouteOption) (removed bool) {
+	route := &Route{Method: method, Path: path}
+	for _, opt := range opts {
+		opt(route)
+	}
+	r.update(func(t *routeTable) {
+		removed = t.remove(method, route.Host, path) != nil
+	})
+	return
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func serveRoute(router *Router, host, path string) (int, string) {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", path, nil)
+	if host != "" {
+		req.Host = host
+	}
+	router.ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
+
+func writeHandle(body string) Handle {
+	return func(w http.ResponseWriter, _ *http.Request, _ Params, _ Jwt) {
+		w.Write([]byte(body))
+	}
+}
+
+func TestRouterReplaceRemove(t *testing.T) {
+	router := New(JwtConfig{})
+	router.GET("/a", writeHandle("a"), Name("a"))
+	router.GET("/b", writeHandle("b"))
+	router.GET("/items/:id<int>", writeHandle("int"))
+	router.GET("/items/:id<uuid>", writeHandle("uuid"))
+	router.GET("/items/:slug", writeHandle("slug"))
+	router.GET("/status", writeHandle("tenant"), Host(":tenant.example.com"))
+
+	if !router.Replace("GET", "/a", writeHandle("a2"), Name("a2")) {
+		t.Fatal("existing route not replaced")
+	}
+	if _, body := serveRoute(router, "", "/a"); body != "a2" {
+		t.Errorf("replaced route: got %q", body)
+	}
+	if _, err := router.URL("a"); err == nil {
+		t.Error("name of replaced route still registered")
+	}
+	if url, err := router.URL("a2"); err != nil || url != "/a" {
+		t.Errorf("name of new route: got %q %v", url, err)
+	}
+	if router.Replace("GET", "/c", writeHandle("c")) {
+		t.Error("missing route replaced")
+	}
+	if code, _ := serveRoute(router, "", "/c"); code != http.StatusNotFound {
+		t.Errorf("failed replacement added route: %d", code)
+	}
+
+	if !router.Remove("GET", "/a") || router.Remove("GET", "/a") {
+		t.Error("wrong result of Remove")
+	}
+	if code, _ := serveRoute(router, "", "/a"); code != http.StatusNotFound {
+		t.Errorf("removed route still served: %d", code)
+	}
+	if _, err := router.URL("a2"); err == nil {
+		t.Error("name of removed route still registered")
+	}
+	if _, body := serveRoute(router, "", "/b"); body != "b" {
+		t.Errorf("other route after removal: got %q", body)
+	}
+
+	// the order of constrained params survives rebuilding the tree
+	router.Remove("GET", "/items/:id<uuid>")
+	for path, want := range map[string]string{"/items/42": "int", "/items/9f4e8a1c-0d2b-4a6e-8c3f-5b7d9e1a2c4f": "slug", "/items/x": "slug"} {
+		if _, body := serveRoute(router, "", path); body != want {
+			t.Errorf("%s: got %q, want %q", path, body, want)
+		}
+	}
+
+	// removing the last route of a host makes the host unknown
+	if router.Remove("GET", "/status") {
+		t.Error("route of host removed without Host option")
+	}
+	router.GET("/status", writeHandle("default"))
+	if !router.Remove("GET", "/status", Host(":tenant.example.com")) {
+		t.Error("route of host not removed")
+	}
+	if _, body := serveRoute(router, "acme.example.com", "/status"); body != "default" {
+		t.Errorf("host without routes: got %q", body)
+	}
+}
+
+func TestRouterCopyOnWrite(t *testing.T) {
+	router := New(JwtConfig{})
+	router.GET("/devices/:id", writeHandle("device"), Name("device"))
+	before := router.loadTable()
+
+	router.GET("/devices/:id/state", writeHandle("state"))
+	if leaf, _, _ := before.trees["GET"].getLeaf("/devices/1/state"); leaf != nil {
+		t.Error("published tree was modified")
+	}
+
+	// failed registrations do not change the routes
+	if recv := catchPanic(func() { router.GET("/other", writeHandle("other"), Name("device")) }); recv == nil {
+		t.Fatal("no panic for duplicate name")
+	}
+	if recv := catchPanic(func() { router.GET("/devices/:name/x", writeHandle("x")) }); recv == nil {
+		t.Fatal("no panic for wildcard conflict")
+	}
+	for _, path := range []string{"/other", "/devices/1/x"} {
+		if code, _ := serveRoute(router, "", path); code != http.StatusNotFound {
+			t.Errorf("%s added by failed registration: %d", path, code)
+		}
+	}
+	if _, body := serveRoute(router, "", "/devices/1/state"); body != "state" {
+		t.Errorf("route lost by failed registration: %q", body)
+	}
+}
+
+func TestRouterConcurrentChanges(t *testing.T) {
+	router := New(JwtConfig{})
+	router.GET("/static", writeHandle("static"))
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, body := serveRoute(router, "", "/static"); body != "static" {
+					t.Errorf("unrelated route disturbed: %q", body)
+					return
+				}
+				serveRoute(router, "", "/dyn/1")
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		path := "/dyn/" + strconv.Itoa(i%10)
+		router.GET(path, writeHandle(path))
+		router.Replace("GET", path, writeHandle(path+"!"))
+		router.Remove("GET", path)
+	}
+	close(stop)
+	wg.Wait()
+
+	if routes := router.Routes(); len(routes) != 1 {
+		t.Errorf("got %d routes, want 1", len(routes))
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TokenCache remembers the claims of validated tokens, so repeated requests
+// with the same token skip the signature check. Entries expire with the token
+// or after MaxAge, whichever comes first. Token bindings and impersonation
+// are still checked on every request.
+//
+// Entries are bound to the issuer, algorithm and key they were verified with.
+// A config sharing the cache only accepts a cached token if it requires the
+// same issuer, accepts the algorithm and still offers the key for it, so a
+// shared cache never skips the checks of another config.
+type TokenCache struct {
+	// MaxEntries limits the number of cached tokens. Defaults to 10000.
+	MaxEntries int
+
+	// MaxAge limits how long a token is cached. Defaults to 5 minutes.
+	MaxAge time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]tokenCacheEntry
+	hits    uint64
+	misses  uint64
+}
+
+type tokenCacheEntry struct {
+	claims   []byte // JSON
+	expires  time.Time
+	verified tokenVerification
+}
+
+// tokenVerification describes how a token was verified.
+type tokenVerification struct {
+	issuer   string
+	kid, alg string
+	key      crypto.PublicKey
+}
+
+// NewTokenCache returns an empty cache with the default limits.
+func NewTokenCache() *TokenCache {
+	return &TokenCache{MaxEntries: 10000, MaxAge: 5 * time.Minute}
+}
+
+// Stats returns the number of lookups which found or missed a token.
+func (c *TokenCache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// get returns the claims of token if it is cached and accept approves how it
+// was verified.
+func (c *TokenCache) get(token string, accept func(tokenVerification) bool) ([]byte, bool) {
+	key := sha256.Sum256([]byte(token))
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok || time.Now().After(entry.expires) || !accept(entry.verified) {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return entry.claims, true
+}
+
+// put caches claims of a token expiring at exp, or never if exp is zero.
+func (c *TokenCache) put(token string, claims []byte, exp time.Time, verified tokenVerification) {
+	maxAge := c.MaxAge
+	if maxAge <= 0 {
+		maxAge = 5 * time.Minute
+	}
+	maxEntries := c.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	expires := time.Now().Add(maxAge)
+	if !exp.IsZero() && exp.Before(expires) {
+		expires = exp
+	}
+
+	key := sha256.Sum256([]byte(token))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[[sha256.Size]byte]tokenCacheEntry{}
+	}
+	if len(c.entries) >= maxEntries {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// still full, drop arbitrary entries
+		for k := range c.entries {
+			if len(c.entries) < maxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = tokenCacheEntry{claims: claims, expires: expires, verified: verified}
+}
+
+// acceptsCached reports whether conf would verify a token the way verified
+// describes, i.e. whether a cached token may skip the signature check.
+func (conf JwtConfig) acceptsCached(verified tokenVerification, algorithms []string) bool {
+	if verified.issuer != conf.Issuer || !contains(algorithms, verified.alg) {
+		return false
+	}
+	var keys []crypto.PublicKey
+	if set, ok := conf.Keys.(keySet); ok {
+		keys = set.candidates(verified.alg)
+	} else if key, err := conf.Keys.PublicKey(verified.kid, verified.alg); err == nil {
+		keys = []crypto.PublicKey{key}
+	}
+	for _, key := range keys {
+		if k, ok := key.(interface{ Equal(crypto.PublicKey) bool }); ok && k.Equal(verified.key) {
+			return true
+		}
+	}
+	return false
+}
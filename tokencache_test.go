@@ -0,0 +1,78 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func acceptAll(tokenVerification) bool {
+	return true
+}
+
+func TestTokenCache(t *testing.T) {
+	cache := &TokenCache{MaxEntries: 2, MaxAge: time.Hour}
+	cache.put("a", []byte(`{"sub":"a"}`), time.Time{}, tokenVerification{})
+	cache.put("expired", []byte(`{"sub":"b"}`), time.Now().Add(-time.Second), tokenVerification{})
+
+	if claims, ok := cache.get("a", acceptAll); !ok || string(claims) != `{"sub":"a"}` {
+		t.Errorf("cached token not found: %s", claims)
+	}
+	if _, ok := cache.get("expired", acceptAll); ok {
+		t.Error("expired token found")
+	}
+
+	cache.put("c", []byte(`{"sub":"c"}`), time.Time{}, tokenVerification{})
+	if len(cache.entries) > 2 {
+		t.Errorf("cache exceeds MaxEntries: %d", len(cache.entries))
+	}
+	if _, ok := cache.get("c", acceptAll); !ok {
+		t.Error("new token not cached")
+	}
+	if hits, misses := cache.Stats(); hits != 2 || misses != 1 {
+		t.Errorf("wrong stats: %d hits, %d misses", hits, misses)
+	}
+}
+
+func TestTokenCacheSharedByConfigs(t *testing.T) {
+	key, other := newTestKey(t), newTestKey(t)
+	cache := NewTokenCache()
+	trusting := JwtConfig{Keys: StaticKeys{&key.PublicKey}, TokenCache: cache}
+	strict := JwtConfig{Keys: StaticKeys{&other.PublicKey}, TokenCache: cache}
+	withIssuer := JwtConfig{Keys: StaticKeys{&key.PublicKey}, Issuer: "https://idp.example.com", TokenCache: cache}
+	rs512Only := JwtConfig{Keys: StaticKeys{&key.PublicKey}, Algorithms: []string{"RS512"}, TokenCache: cache}
+
+	auth := signedAuth(t, key, jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice"})
+	var token Jwt
+	if err := trusting.validate(auth, &token); err != nil {
+		t.Fatal(err)
+	}
+	for name, conf := range map[string]JwtConfig{"keys": strict, "issuer": withIssuer, "algorithms": rs512Only} {
+		if err := conf.validate(auth, &token); err == nil {
+			t.Errorf("%s: token cached for another config accepted", name)
+		}
+	}
+	if err := trusting.validate(auth, &token); err != nil {
+		t.Errorf("cached token rejected by its config: %v", err)
+	}
+	if hits, _ := cache.Stats(); hits != 1 {
+		t.Errorf("got %d hits, want 1", hits)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// TraceContext identifies a span across services as defined by the W3C Trace
+// Context recommendation.
+type TraceContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+	Flags   byte
+
+	// State is the vendor specific "tracestate" header, passed on unchanged.
+	State string
+}
+
+// ParseTraceparent parses a "traceparent" header value. It returns false for
+// malformed values and all-zero ids.
+func ParseTraceparent(s string) (tc TraceContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return tc, false
+	}
+	// version 00 has exactly four fields, later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return tc, false
+	}
+	var version, flags [1]byte
+	if !decodeHex(version[:], parts[0]) || !decodeHex(tc.TraceId[:], parts[1]) ||
+		!decodeHex(tc.SpanId[:], parts[2]) || !decodeHex(flags[:], parts[3]) {
+		return TraceContext{}, false
+	}
+	tc.Flags = flags[0]
+	return tc, tc.IsValid()
+}
+
+func decodeHex(dst []byte, s string) bool {
+	// upper case hex is not allowed
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// IsValid reports whether trace and span id are non-zero.
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceId != [16]byte{} && tc.SpanId != [8]byte{}
+}
+
+// Sampled reports whether the sampled flag is set.
+func (tc TraceContext) Sampled() bool {
+	return tc.Flags&1 == 1
+}
+
+// Traceparent formats tc as a version 00 "traceparent" header value.
+func (tc TraceContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(tc.TraceId[:]) + "-" + hex.EncodeToString(tc.SpanId[:]) + "-" + hex.EncodeToString([]byte{tc.Flags})
+}
+
+// Inject sets the "traceparent" and "tracestate" headers of an outgoing
+// request. Invalid contexts are not injected.
+func (tc TraceContext) Inject(header http.Header) {
+	if !tc.IsValid() {
+		return
+	}
+	header.Set("traceparent", tc.Traceparent())
+	if tc.State != "" {
+		header.Set("tracestate", tc.State)
+	}
+}
+
+// extractTraceContext reads the trace context of an incoming request.
+func extractTraceContext(header http.Header) (TraceContext, bool) {
+	tc, ok := ParseTraceparent(header.Get("traceparent"))
+	if ok {
+		tc.State = header.Get("tracestate")
+	}
+	return tc, ok
+}
+
+type traceContextKey struct{}
+
+// ContextWithTrace returns a copy of ctx carrying tc.
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceFromContext returns the trace context of the current span, which is
+// the span of the router or, without Router.Tracer, the incoming trace.
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}
+
+// Tracer starts spans in a tracing backend.
+// Implementations must be safe for concurrent use.
+type Tracer interface {
+	// StartSpan starts a span named name. parent is the trace context of the
+	// span in ctx or, without one, of the incoming request. It is invalid if
+	// there is neither.
+	StartSpan(ctx context.Context, name string, parent TraceContext) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	// SetAttribute tags the span.
+	SetAttribute(key string, value interface{})
+
+	// Context returns the trace context propagated to outgoing requests.
+	Context() TraceContext
+
+	// End finishes the span.
+	End()
+}
+
+// Span attributes set by the router.
+const (
+	SpanAttributeUserId     = "enduser.id"
+	SpanAttributeAuthMethod = "auth.method"
+	SpanAttributeAuthResult = "auth.outcome"
+	SpanAttributeAuthReason = "auth.reason"
+	SpanAttributeRoute      = "http.route"
+	SpanAttributeMethod     = "http.method"
+)
+
+// nopSpan is used without Router.Tracer. It only passes on the incoming trace
+// context.
+type nopSpan struct {
+	tc TraceContext
+}
+
+func (s nopSpan) SetAttribute(string, interface{}) {}
+func (s nopSpan) Context() TraceContext            { return s.tc }
+func (s nopSpan) End()                             {}
+
+// startSpan starts the span of a request to route and adds its trace context
+// to the request context. The parent is the span of the request context, e.g.
+// of a router mounting this one, or else the incoming trace.
+func (r *Router) startSpan(req *http.Request, route *Route) (*http.Request, Span) {
+	parent, inContext := TraceFromContext(req.Context())
+	if !inContext {
+		parent, _ = extractTraceContext(req.Header)
+	}
+	if r.Tracer == nil {
+		if !parent.IsValid() || inContext {
+			return req, nopSpan{parent}
+		}
+		return req.WithContext(ContextWithTrace(req.Context(), parent)), nopSpan{parent}
+	}
+
+	name := req.Method
+	if route != nil {
+		name += " " + route.Path
+	}
+	ctx, span := r.Tracer.StartSpan(req.Context(), name, parent)
+	span.SetAttribute(SpanAttributeMethod, req.Method)
+	if route != nil {
+		span.SetAttribute(SpanAttributeRoute, route.Path)
+	}
+	if tc := span.Context(); tc.IsValid() {
+		ctx = ContextWithTrace(ctx, tc)
+	}
+	return req.WithContext(ctx), span
+}
+
+// traceAuth tags span with the result of the authentication.
+func traceAuth(span Span, token Jwt, err error) {
+	if token.UserId != "" {
+		span.SetAttribute(SpanAttributeUserId, token.UserId)
+	}
+	if token.AuthMethod != "" {
+		span.SetAttribute(SpanAttributeAuthMethod, token.AuthMethod)
+	}
+	if err != nil {
+		span.SetAttribute(SpanAttributeAuthResult, AuditFailure)
+		span.SetAttribute(SpanAttributeAuthReason, auditReason(err))
+	} else {
+		span.SetAttribute(SpanAttributeAuthResult, AuditSuccess)
+	}
+}
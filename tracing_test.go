@@ -0,0 +1,176 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		tc, ok := ParseTraceparent(test.header)
+		if ok != test.ok {
+			t.Errorf("%q: got %v, want %v", test.header, ok, test.ok)
+		}
+		if ok && test.header[:2] == "00" && tc.Traceparent() != test.header {
+			t.Errorf("%q: formatted as %q", test.header, tc.Traceparent())
+		}
+	}
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+type testSpan struct {
+	name       string
+	parent     TraceContext
+	tc         TraceContext
+	attributes map[string]interface{}
+	ended      bool
+}
+
+func (tr *testTracer) StartSpan(ctx context.Context, name string, parent TraceContext) (context.Context, Span) {
+	span := &testSpan{name: name, parent: parent, tc: parent, attributes: map[string]interface{}{}}
+	span.tc.SpanId = [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, span)
+	tr.mu.Unlock()
+	return ctx, span
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) { s.attributes[key] = value }
+func (s *testSpan) Context() TraceContext                      { return s.tc }
+func (s *testSpan) End()                                       { s.ended = true }
+
+func TestRouterTracing(t *testing.T) {
+	var upstreamTraceparent, upstreamTracestate string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		upstreamTracestate = r.Header.Get("tracestate")
+	}))
+	defer upstream.Close()
+
+	key := newTestKey(t)
+	router := New(JwtConfig{PubRsa: string(publicKeyPEM(t, key))})
+	router.GET("/users/:id", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {
+		resp, err := jwt.Impersonate.GetWithContext(r.Context(), upstream.URL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	})
+	serve := func(auth string) {
+		req, _ := http.NewRequest("GET", "/users/1", nil)
+		req.Header.Set("Authorization", auth)
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		req.Header.Set("tracestate", "vendor=value")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	alice := signedAuth(t, key, jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice"})
+
+	// without tracer the incoming context is passed on
+	serve(alice)
+	if upstreamTraceparent != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" || upstreamTracestate != "vendor=value" {
+		t.Errorf("trace context not passed on: %q %q", upstreamTraceparent, upstreamTracestate)
+	}
+
+	tracer := &testTracer{}
+	router.Tracer = tracer
+	serve(alice)
+	serve("Bearer invalid")
+	if len(tracer.spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(tracer.spans))
+	}
+	span := tracer.spans[0]
+	if span.name != "GET /users/:id" || !span.ended || span.parent.Traceparent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("wrong span: %+v", span)
+	}
+	if span.attributes[SpanAttributeUserId] != "alice" || span.attributes[SpanAttributeAuthResult] != AuditSuccess {
+		t.Errorf("wrong attributes: %v", span.attributes)
+	}
+	if upstreamTraceparent != "00-4bf92f3577b34da6a3ce929d0e0e4736-0102030405060708-01" {
+		t.Errorf("span context not injected: %q", upstreamTraceparent)
+	}
+	if attributes := tracer.spans[1].attributes; attributes[SpanAttributeAuthResult] != AuditFailure || attributes[SpanAttributeAuthReason] != AuditReasonInvalidCredentials {
+		t.Errorf("wrong attributes of failed request: %v", attributes)
+	}
+}
+
+func TestRouterTracingMounted(t *testing.T) {
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+	}))
+	defer upstream.Close()
+
+	tracer := &testTracer{}
+	devices := New(JwtConfig{})
+	devices.Tracer = tracer
+	devices.GET("/:id", func(w http.ResponseWriter, r *http.Request, ps Params, jwt Jwt) {
+		// the calls without context pass on the trace as well
+		resp, err := jwt.Impersonate.Get(upstream.URL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	})
+	router := New(JwtConfig{})
+	router.Tracer = tracer
+	router.Mount("/devices", devices)
+
+	req, _ := http.NewRequest("GET", "/devices/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(tracer.spans))
+	}
+	if parent := tracer.spans[0].parent.Traceparent(); parent != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("outer span not a child of the incoming trace: %s", parent)
+	}
+	// the test tracer gives every span the id 0102030405060708
+	if parent := tracer.spans[1].parent.Traceparent(); parent != "00-4bf92f3577b34da6a3ce929d0e0e4736-0102030405060708-01" {
+		t.Errorf("mounted span not a child of the outer span: %s", parent)
+	}
+	if upstreamTraceparent != "00-4bf92f3577b34da6a3ce929d0e0e4736-0102030405060708-01" {
+		t.Errorf("trace not passed on without context: %q", upstreamTraceparent)
+	}
+}
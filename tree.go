@@ -19,7 +19,6 @@ package jwt_http_router
 import (
 	"net/url"
 	"strings"
-	"unicode"
 	"unicode/utf8"
 )
 
@@ -37,6 +36,8 @@ func countParams(path string) uint8 {
 			continue
 		}
 		n++
+		// skip the constraint, it may contain ':' and '*'
+		i += wildcardEnd(path[i:]) - 1
 	}
 	if n >= 255 {
 		return 255
@@ -53,18 +54,28 @@ const (
 	catchAll
 )
 
+// A node has static children, which are indexed by the first byte of their
+// path, followed by its param children and at most one catch-all child.
+// Static children take priority over param children, which take priority over
+// the catch-all child. Param children with a constraint come before the one
+// without.
 type node struct {
 	path      string
-	wildChild bool
+	wildChild bool // has a param or catch-all child
 	nType     nodeType
 	maxParams uint8
-	indices   string
+	indices   string // first bytes of the static children
 	children  []*node
 	handle    Handle
+	route     *Route
 	priority  uint32
+
+	// parameter name and constraint of param and catch-all nodes
+	key        string
+	constraint *constraint
 }
 
-// increments priority of the given child and reorders if necessary
+// increments priority of the given static child and reorders if necessary
 func (n *node) incrementChildPrio(pos int) int {
 	n.children[pos].priority++
 	prio := n.children[pos].priority
@@ -88,40 +99,127 @@ func (n *node) incrementChildPrio(pos int) int {
 	return newPos
 }
 
-// addRoute adds a node with the given handle to the path.
+// wildRank orders the wildcard children of a node.
+func (n *node) wildRank() int {
+	switch {
+	case n.nType == param && n.constraint != nil:
+		return 0
+	case n.nType == param:
+		return 1
+	}
+	return 2
+}
+
+// checkWildcards panics if a wildcard of path is malformed.
+func checkWildcards(path string) {
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c != ':' && c != '*' {
+			continue
+		}
+
+		// find wildcard end (a static delimiter, '/' or path end)
+		end := i + 1
+		if c == ':' {
+			end = i + wildcardEnd(path[i:])
+		} else {
+			for end < len(path) && path[end] != '/' {
+				end++
+			}
+		}
+		key, constraint := splitWildcard(path[i+1 : end])
+		for j := 0; j < len(key); j++ {
+			if key[j] == ':' || key[j] == '*' {
+				panic("wildcards in a path segment must be separated by a static delimiter, has: '" +
+					path[i:] + "' in path '" + path + "'")
+			}
+		}
+
+		if key == "" {
+			panic("wildcards must be named with a non-empty name in path '" + path + "'")
+		}
+
+		if end < len(path) && (path[end] == ':' || path[end] == '*') {
+			panic("wildcards in a path segment must be separated by a static delimiter, has: '" +
+				path[i:] + "' in path '" + path + "'")
+		}
+		if end > i+1+len(key) {
+			if c == '*' {
+				panic("catch-all parameters can not have constraints in path '" + path + "'")
+			}
+			if constraint == "" {
+				panic("constraints must not be empty in path '" + path + "'")
+			}
+			parseConstraint(constraint)
+		}
+
+		if c == '*' {
+			if end != len(path) {
+				panic("catch-all routes are only allowed at the end of the path in path '" + path + "'")
+			}
+			if i == 0 || path[i-1] != '/' {
+				panic("no / before catch-all in path '" + path + "'")
+			}
+		}
+		i = end - 1
+	}
+}
+
+// addRoute adds a node with the given handle to the path and returns the leaf
+// holding the handle. The children of n on the way to the leaf are replaced by
+// copies, so trees sharing them with n are not modified. n itself is modified.
 // Not concurrency-safe!
-func (n *node) addRoute(path string, handle Handle) {
+func (n *node) addRoute(path string, handle Handle) *node {
 	fullPath := path
-	n.priority++
+	checkWildcards(fullPath)
 	numParams := countParams(path)
+	n.priority++
 
-	// non-empty tree
-	if len(n.path) > 0 || len(n.children) > 0 {
-	walk:
-		for {
-			// Update maxParams of the current node
-			if numParams > n.maxParams {
-				n.maxParams = numParams
-			}
+	// empty tree
+	if n.path == "" && len(n.children) == 0 && n.handle == nil {
+		n.nType = root
+		end := strings.IndexAny(path, ":*")
+		if end < 0 {
+			end = len(path)
+		}
+		n.path = path[:end]
+	}
 
-			// Find the longest common prefix.
-			// This also implies that the common prefix contains no ':' or '*'
-			// since the existing key can't contain those chars.
+walk:
+	for {
+		// Update maxParams of the current node
+		if numParams > n.maxParams {
+			n.maxParams = numParams
+		}
+
+		if n.nType == param || n.nType == catchAll {
+			// the wildcard name was matched by the parent
+			path = path[len(n.path):]
+			numParams--
+		} else {
+			// Find the longest common prefix, which ends at a rune
+			// boundary, so every static node holds valid UTF-8.
 			i := 0
 			max := min(len(path), len(n.path))
 			for i < max && path[i] == n.path[i] {
 				i++
 			}
+			if i < len(n.path) {
+				for i > 0 && !utf8.RuneStart(n.path[i]) {
+					i--
+				}
+			}
 
 			// Split edge
 			if i < len(n.path) {
-				child := node{
+				child := &node{
 					path:      n.path[i:],
 					wildChild: n.wildChild,
 					nType:     static,
 					indices:   n.indices,
 					children:  n.children,
 					handle:    n.handle,
+					route:     n.route,
 					priority:  n.priority - 1,
 				}
 
@@ -132,207 +230,144 @@ func (n *node) addRoute(path string, handle Handle) {
 					}
 				}
 
-				n.children = []*node{&child}
-				// []byte for proper unicode char conversion, see #65
+				n.children = []*node{child}
 				n.indices = string([]byte{n.path[i]})
 				n.path = path[:i]
-				n.handle = nil
 				n.wildChild = false
+				n.handle = nil
+				n.route = nil
+			}
+			path = path[i:]
+		}
+
+		if len(path) == 0 {
+			if n.handle != nil {
+				panic("a handle is already registered for path '" + fullPath + "'")
 			}
+			n.handle = handle
+			return n
+		}
 
-			// Make new node a child of this node
-			if i < len(path) {
-				path = path[i:]
+		c := path[0]
 
-				if n.wildChild {
-					n = n.children[0]
-					n.priority++
+		// wildcard child
+		if c == ':' || c == '*' {
+			nType, end := param, wildcardEnd(path)
+			if c == '*' {
+				nType = catchAll
+			}
+			key, constraint := splitWildcard(path[1:end])
+			child := &node{nType: nType, path: path[:end], priority: 1, key: key}
+			if end > 1+len(key) {
+				child.constraint = parseConstraint(constraint)
+			}
 
-					// Update maxParams of the child node
-					if numParams > n.maxParams {
-						n.maxParams = numParams
-					}
-					numParams--
-
-					// Check if the wildcard matches
-					if len(path) >= len(n.path) && n.path == path[:len(n.path)] &&
-						// Check for longer wildcard, e.g. :name and :names
-						(len(n.path) >= len(path) || path[len(n.path)] == '/') {
-						continue walk
-					} else {
-						// Wildcard conflict
-						var pathSeg string
-						if n.nType == catchAll {
-							pathSeg = path
-						} else {
-							pathSeg = strings.SplitN(path, "/", 2)[0]
-						}
-						prefix := fullPath[:strings.Index(fullPath, pathSeg)] + n.path
+			pos := len(n.children)
+			for i := len(n.indices); i < len(n.children); i++ {
+				other := n.children[i]
+				if other.nType == nType && other.path[1+len(other.key):] == path[1+len(key):end] {
+					if other.key != key {
+						pathSeg := path[:end]
+						prefix := fullPath[:strings.Index(fullPath, pathSeg)] + other.path
 						panic("'" + pathSeg +
 							"' in new path '" + fullPath +
-							"' conflicts with existing wildcard '" + n.path +
+							"' conflicts with existing wildcard '" + other.path +
 							"' in existing prefix '" + prefix +
 							"'")
 					}
-				}
-
-				c := path[0]
-
-				// slash after param
-				if n.nType == param && c == '/' && len(n.children) == 1 {
-					n = n.children[0]
-					n.priority++
+					other = other.copy()
+					other.priority++
+					n.children[i] = other
+					n = other
 					continue walk
 				}
-
-				// Check if a child with the next path byte exists
-				for i := 0; i < len(n.indices); i++ {
-					if c == n.indices[i] {
-						i = n.incrementChildPrio(i)
-						n = n.children[i]
-						continue walk
-					}
+				if pos == len(n.children) && child.wildRank() < other.wildRank() {
+					pos = i
 				}
-
-				// Otherwise insert it
-				if c != ':' && c != '*' {
-					// []byte for proper unicode char conversion, see #65
-					n.indices += string([]byte{c})
-					child := &node{
-						maxParams: numParams,
-					}
-					n.children = append(n.children, child)
-					n.incrementChildPrio(len(n.indices) - 1)
-					n = child
-				}
-				n.insertChild(numParams, path, fullPath, handle)
-				return
-
-			} else if i == len(path) { // Make node a (in-path) leaf
-				if n.handle != nil {
-					panic("a handle is already registered for path '" + fullPath + "'")
-				}
-				n.handle = handle
-			}
-			return
-		}
-	} else { // Empty tree
-		n.insertChild(numParams, path, fullPath, handle)
-		n.nType = root
-	}
-}
-
-func (n *node) insertChild(numParams uint8, path, fullPath string, handle Handle) {
-	var offset int // already handled bytes of the path
-
-	// find prefix until first wildcard (beginning with ':'' or '*'')
-	for i, max := 0, len(path); numParams > 0; i++ {
-		c := path[i]
-		if c != ':' && c != '*' {
-			continue
-		}
-
-		// find wildcard end (either '/' or path end)
-		end := i + 1
-		for end < max && path[end] != '/' {
-			switch path[end] {
-			// the wildcard name must not contain ':' and '*'
-			case ':', '*':
-				panic("only one wildcard per path segment is allowed, has: '" +
-					path[i:] + "' in path '" + fullPath + "'")
-			default:
-				end++
 			}
-		}
-
-		// check if this Node existing children which would be
-		// unreachable if we insert the wildcard here
-		if len(n.children) > 0 {
-			panic("wildcard route '" + path[i:end] +
-				"' conflicts with existing children in path '" + fullPath + "'")
-		}
 
-		// check if the wildcard has a name
-		if end-i < 2 {
-			panic("wildcards must be named with a non-empty name in path '" + fullPath + "'")
-		}
-
-		if c == ':' { // param
-			// split path at the beginning of the wildcard
-			if i > 0 {
-				n.path = path[offset:i]
-				offset = i
-			}
-
-			child := &node{
-				nType:     param,
-				maxParams: numParams,
-			}
-			n.children = []*node{child}
+			n.children = append(n.children, nil)
+			copy(n.children[pos+1:], n.children[pos:])
+			n.children[pos] = child
 			n.wildChild = true
 			n = child
-			n.priority++
-			numParams--
-
-			// if the path doesn't end with the wildcard, then there
-			// will be another non-wildcard subpath starting with '/'
-			if end < max {
-				n.path = path[offset:end]
-				offset = end
+			continue walk
+		}
 
-				child := &node{
-					maxParams: numParams,
-					priority:  1,
+		// static child starting with the same rune
+		r, _ := utf8.DecodeRuneInString(path)
+		for i := 0; i < len(n.indices); i++ {
+			if c == n.indices[i] {
+				if cr, _ := utf8.DecodeRuneInString(n.children[i].path); cr == r {
+					n.children[i] = n.children[i].copy()
+					i = n.incrementChildPrio(i)
+					n = n.children[i]
+					continue walk
 				}
-				n.children = []*node{child}
-				n = child
-			}
-
-		} else { // catchAll
-			if end != max || numParams > 1 {
-				panic("catch-all routes are only allowed at the end of the path in path '" + fullPath + "'")
 			}
+		}
 
-			if len(n.path) > 0 && n.path[len(n.path)-1] == '/' {
-				panic("catch-all conflicts with existing handle for the path segment root in path '" + fullPath + "'")
-			}
+		// new static child up to the next wildcard, inserted before the
+		// wildcard children
+		end := strings.IndexAny(path, ":*")
+		if end < 0 {
+			end = len(path)
+		}
+		child := &node{path: path[:end]}
+		pos := len(n.indices)
+		n.children = append(n.children, nil)
+		copy(n.children[pos+1:], n.children[pos:])
+		n.children[pos] = child
+		n.indices += string([]byte{c})
+		n = n.children[n.incrementChildPrio(pos)]
+	}
+}
 
-			// currently fixed width 1 for '/'
-			i--
-			if path[i] != '/' {
-				panic("no / before catch-all in path '" + fullPath + "'")
-			}
+// copy returns a copy of n with its own children slice. The children are
+// shared.
+func (n *node) copy() *node {
+	c := *n
+	c.children = append([]*node(nil), n.children...)
+	return &c
+}
 
-			n.path = path[offset:i]
+// walkPatterns calls fn with the registered path of every node with a handle,
+// in the order of the tree.
+func (n *node) walkPatterns(prefix string, fn func(pattern string, leaf *node)) {
+	prefix += n.path
+	if n.handle != nil {
+		fn(prefix, n)
+	}
+	for _, child := range n.children {
+		child.walkPatterns(prefix, fn)
+	}
+}
 
-			// first node: catchAll node with empty path
-			child := &node{
-				wildChild: true,
-				nType:     catchAll,
-				maxParams: 1,
-			}
-			n.children = []*node{child}
-			n.indices = string(path[i])
-			n = child
-			n.priority++
-
-			// second node: node holding the variable
-			child = &node{
-				path:      path[i:],
-				nType:     catchAll,
-				maxParams: 1,
-				handle:    handle,
-				priority:  1,
-			}
-			n.children = []*node{child}
+// find returns the node holding the handle registered with pattern.
+func (n *node) find(pattern string) (leaf *node) {
+	n.walkPatterns("", func(p string, l *node) {
+		if p == pattern {
+			leaf = l
+		}
+	})
+	return
+}
 
+// without returns a new tree with all handles of n except the one registered
+// with pattern, or nil if none is left. Adding the handles in the order of the
+// tree keeps the order of param children with constraints.
+func (n *node) without(pattern string) *node {
+	var tree *node
+	n.walkPatterns("", func(p string, leaf *node) {
+		if p == pattern {
 			return
 		}
-	}
-
-	// insert remaining path part and handle to the leaf
-	n.path = path[offset:]
-	n.handle = handle
+		if tree == nil {
+			tree = new(node)
+		}
+		tree.addRoute(p, leaf.handle).route = leaf.route
+	})
+	return tree
 }
 
 // Returns the handle registered with the given path (key). The values of
@@ -341,130 +376,147 @@ func (n *node) insertChild(numParams uint8, path, fullPath string, handle Handle
 // made if a handle exists with an extra (without the) trailing slash for the
 // given path.
 func (n *node) getValue(path string) (handle Handle, p Params, tsr bool) {
-walk: // outer loop for walking the tree
-	for {
-		if len(path) > len(n.path) {
-			if path[:len(n.path)] == n.path {
-				path = path[len(n.path):]
-				// If this node does not have a wildcard (param or catchAll)
-				// child,  we can just look up the next child node and continue
-				// to walk down the tree
-				if !n.wildChild {
-					c := path[0]
-					for i := 0; i < len(n.indices); i++ {
-						if c == n.indices[i] {
-							n = n.children[i]
-							continue walk
-						}
-					}
-
-					// Nothing found.
-					// We can recommend to redirect to the same URL without a
-					// trailing slash if a leaf exists for that path.
-					tsr = (path == "/" && n.handle != nil)
-					return
+	leaf, p, tsr := n.getLeaf(path)
+	if leaf != nil {
+		handle = leaf.handle
+	}
+	return
+}
 
-				}
+// getLeaf works like getValue, but returns the node holding the handle.
+func (n *node) getLeaf(path string) (leaf *node, p Params, tsr bool) {
+	leaf, p = n.match(path, 0, p, 0, n.maxParams)
+	if leaf != nil {
+		return
+	}
 
-				// handle wildcard child
-				n = n.children[0]
-				switch n.nType {
-				case param:
-					// find param end (either '/' or path end)
-					end := 0
-					for end < len(path) && path[end] != '/' {
-						end++
-					}
+	// Nothing found. We can recommend to redirect to the same URL with an
+	// extra trailing slash or without it.
+	var alt *node
+	if len(path) > 1 && path[len(path)-1] == '/' {
+		alt, _ = n.match(path[:len(path)-1], 0, nil, 0, n.maxParams)
+	} else {
+		alt, _ = n.match(path+"/", 0, nil, 0, n.maxParams)
+	}
+	tsr = alt != nil
+	return
+}
 
-					// save param value
-					if p == nil {
-						// lazy allocation
-						p = make(Params, 0, n.maxParams)
-					}
-					i := len(p)
-					p = p[:i+1] // expand slice within preallocated capacity
-					p[i].Key = n.path[1:]
-					var err error
-					p[i].Value, err = url.PathUnescape(path[:end])
-					if err != nil {
-						p[i].Value = path[:end]
-					}
+// match matches path[pos:] against the subtree of n. Wildcard values are
+// written to p at index depth. If a branch does not lead to a handle, the next
+// one is tried in the order static, param, catch-all. The values of the last
+// failed attempt stay in p if nothing matches.
+func (n *node) match(path string, pos int, p Params, depth int, maxParams uint8) (*node, Params) {
+	switch n.nType {
+	case static, root:
+		if len(path)-pos < len(n.path) || path[pos:pos+len(n.path)] != n.path {
+			return nil, p
+		}
+		return n.matchChildren(path, pos+len(n.path), p, depth, maxParams)
 
-					// we need to go deeper!
-					if end < len(path) {
-						if len(n.children) > 0 {
-							path = path[end:]
-							n = n.children[0]
-							continue walk
-						}
-
-						// ... but we can't
-						tsr = (len(path) == end+1)
-						return
-					}
+	case param:
+		// find segment end (either '/' or path end)
+		segEnd := pos
+		for segEnd < len(path) && path[segEnd] != '/' {
+			segEnd++
+		}
 
-					if handle = n.handle; handle != nil {
-						return
-					} else if len(n.children) == 1 {
-						// No handle found. Check if a handle for this path + a
-						// trailing slash exists for TSR recommendation
-						n = n.children[0]
-						tsr = (n.path == "/" && n.handle != nil)
-					}
+		// The value is the whole segment or, if a static delimiter follows
+		// the param, ends before an occurrence of the delimiter. Longer
+		// values are tried first.
+		delimited := n.hasDelimiter()
+		for end := segEnd; end > pos; end-- {
+			if end < segEnd && !(delimited && n.isDelimiter(path[end])) {
+				continue
+			}
+			value := path[pos:end]
+			if unescaped, err := url.PathUnescape(value); err == nil {
+				value = unescaped
+			}
+			if n.constraint != nil && !n.constraint.match(value) {
+				continue
+			}
+			p = setParam(p, depth, maxParams, n.key, value)
+			var leaf *node
+			if leaf, p = n.matchChildren(path, end, p, depth+1, maxParams); leaf != nil {
+				return leaf, p
+			}
+			if !delimited {
+				break
+			}
+		}
+		return nil, p
 
-					return
+	case catchAll:
+		if n.handle == nil {
+			return nil, p
+		}
+		// the value starts with the '/' of the parent
+		p = setParam(p, depth, maxParams, n.key, path[pos-1:])
+		return n, p[:depth+1]
 
-				case catchAll:
-					// save param value
-					if p == nil {
-						// lazy allocation
-						p = make(Params, 0, n.maxParams)
-					}
-					i := len(p)
-					p = p[:i+1] // expand slice within preallocated capacity
-					p[i].Key = n.path[2:]
-					p[i].Value = path
+	default:
+		panic("invalid node type")
+	}
+}
 
-					handle = n.handle
-					return
+// matchChildren matches path[pos:] against the children of n, or returns n if
+// the path ends here.
+func (n *node) matchChildren(path string, pos int, p Params, depth int, maxParams uint8) (*node, Params) {
+	if pos == len(path) && n.handle != nil {
+		if p != nil {
+			p = p[:depth]
+		}
+		return n, p
+	}
 
-				default:
-					panic("invalid node type")
+	if pos < len(path) {
+		c := path[pos]
+		for i := 0; i < len(n.indices); i++ {
+			if c == n.indices[i] {
+				var leaf *node
+				if leaf, p = n.children[i].match(path, pos, p, depth, maxParams); leaf != nil {
+					return leaf, p
 				}
 			}
-		} else if path == n.path {
-			// We should have reached the node containing the handle.
-			// Check if this node has a handle registered.
-			if handle = n.handle; handle != nil {
-				return
-			}
-
-			if path == "/" && n.wildChild && n.nType != root {
-				tsr = true
-				return
-			}
+		}
+	}
 
-			// No handle found. Check if a handle for this path + a
-			// trailing slash exists for trailing slash recommendation
-			for i := 0; i < len(n.indices); i++ {
-				if n.indices[i] == '/' {
-					n = n.children[i]
-					tsr = (len(n.path) == 1 && n.handle != nil) ||
-						(n.nType == catchAll && n.children[0].handle != nil)
-					return
-				}
+	if n.wildChild {
+		for _, child := range n.children[len(n.indices):] {
+			var leaf *node
+			if leaf, p = child.match(path, pos, p, depth, maxParams); leaf != nil {
+				return leaf, p
 			}
+		}
+	}
+	return nil, p
+}
 
-			return
+// hasDelimiter reports whether a param node has a static child in the same
+// path segment, like the "." of "/:name.:ext".
+func (n *node) hasDelimiter() bool {
+	for i := 0; i < len(n.indices); i++ {
+		if n.indices[i] != '/' {
+			return true
 		}
+	}
+	return false
+}
 
-		// Nothing found. We can recommend to redirect to the same URL with an
-		// extra trailing slash if a leaf exists for that path
-		tsr = (path == "/") ||
-			(len(n.path) == len(path)+1 && n.path[len(path)] == '/' &&
-				path == n.path[:len(n.path)-1] && n.handle != nil)
-		return
+func (n *node) isDelimiter(c byte) bool {
+	return c != '/' && strings.IndexByte(n.indices, c) >= 0
+}
+
+// setParam sets the parameter at index depth, allocating p on first use.
+func setParam(p Params, depth int, maxParams uint8, key, value string) Params {
+	if p == nil {
+		// lazy allocation
+		p = make(Params, 0, maxParams)
 	}
+	p = p[:depth+1]
+	p[depth] = Param{Key: key, Value: value}
+	return p
 }
 
 // Makes a case-insensitive lookup of the given path and tries to find a handler.
@@ -472,202 +524,78 @@ walk: // outer loop for walking the tree
 // It returns the case-corrected path and a bool indicating whether the lookup
 // was successful.
 func (n *node) findCaseInsensitivePath(path string, fixTrailingSlash bool) (ciPath []byte, found bool) {
-	return n.findCaseInsensitivePathRec(
-		path,
-		strings.ToLower(path),
-		make([]byte, 0, len(path)+1), // preallocate enough memory for new path
-		[4]byte{},                    // empty rune buffer
-		fixTrailingSlash,
-	)
-}
-
-// shift bytes in array by n bytes left
-func shiftNRuneBytes(rb [4]byte, n int) [4]byte {
-	switch n {
-	case 0:
-		return rb
-	case 1:
-		return [4]byte{rb[1], rb[2], rb[3], 0}
-	case 2:
-		return [4]byte{rb[2], rb[3]}
-	case 3:
-		return [4]byte{rb[3]}
-	default:
-		return [4]byte{}
+	buf := make([]byte, 0, len(path)+1) // preallocate enough memory for new path
+	ciPath = n.matchCaseInsensitive(path, 0, buf)
+	if ciPath == nil && fixTrailingSlash {
+		if len(path) > 1 && path[len(path)-1] == '/' {
+			ciPath = n.matchCaseInsensitive(path[:len(path)-1], 0, buf)
+		} else {
+			ciPath = n.matchCaseInsensitive(path+"/", 0, buf)
+		}
 	}
+	return ciPath, ciPath != nil
 }
 
-// recursive case-insensitive lookup function used by n.findCaseInsensitivePath
-func (n *node) findCaseInsensitivePathRec(path, loPath string, ciPath []byte, rb [4]byte, fixTrailingSlash bool) ([]byte, bool) {
-	loNPath := strings.ToLower(n.path)
-
-walk: // outer loop for walking the tree
-	for len(loPath) >= len(loNPath) && (len(loNPath) == 0 || loPath[1:len(loNPath)] == loNPath[1:]) {
-		// add common path to result
-		ciPath = append(ciPath, n.path...)
-
-		if path = path[len(n.path):]; len(path) > 0 {
-			loOld := loPath
-			loPath = loPath[len(loNPath):]
-
-			// If this node does not have a wildcard (param or catchAll) child,
-			// we can just look up the next child node and continue to walk down
-			// the tree
-			if !n.wildChild {
-				// skip rune bytes already processed
-				rb = shiftNRuneBytes(rb, len(loNPath))
-
-				if rb[0] != 0 {
-					// old rune not finished
-					for i := 0; i < len(n.indices); i++ {
-						if n.indices[i] == rb[0] {
-							// continue with child node
-							n = n.children[i]
-							loNPath = strings.ToLower(n.path)
-							continue walk
-						}
-					}
-				} else {
-					// process a new rune
-					var rv rune
-
-					// find rune start
-					// runes are up to 4 byte long,
-					// -4 would definitely be another rune
-					var off int
-					for max := min(len(loNPath), 3); off < max; off++ {
-						if i := len(loNPath) - off; utf8.RuneStart(loOld[i]) {
-							// read rune from cached lowercase path
-							rv, _ = utf8.DecodeRuneInString(loOld[i:])
-							break
-						}
-					}
-
-					// calculate lowercase bytes of current rune
-					utf8.EncodeRune(rb[:], rv)
-					// skipp already processed bytes
-					rb = shiftNRuneBytes(rb, off)
-
-					for i := 0; i < len(n.indices); i++ {
-						// lowercase matches
-						if n.indices[i] == rb[0] {
-							// must use a recursive approach since both the
-							// uppercase byte and the lowercase byte might exist
-							// as an index
-							if out, found := n.children[i].findCaseInsensitivePathRec(
-								path, loPath, ciPath, rb, fixTrailingSlash,
-							); found {
-								return out, true
-							}
-							break
-						}
-					}
-
-					// same for uppercase rune, if it differs
-					if up := unicode.ToUpper(rv); up != rv {
-						utf8.EncodeRune(rb[:], up)
-						rb = shiftNRuneBytes(rb, off)
-
-						for i := 0; i < len(n.indices); i++ {
-							// uppercase matches
-							if n.indices[i] == rb[0] {
-								// continue with child node
-								n = n.children[i]
-								loNPath = strings.ToLower(n.path)
-								continue walk
-							}
-						}
-					}
-				}
-
-				// Nothing found. We can recommend to redirect to the same URL
-				// without a trailing slash if a leaf exists for that path
-				return ciPath, (fixTrailingSlash && path == "/" && n.handle != nil)
-			}
-
-			n = n.children[0]
-			switch n.nType {
-			case param:
-				// find param end (either '/' or path end)
-				k := 0
-				for k < len(path) && path[k] != '/' {
-					k++
-				}
+// matchCaseInsensitive works like match, but compares static paths case
+// insensitively. It appends the path as registered to ciPath.
+func (n *node) matchCaseInsensitive(path string, pos int, ciPath []byte) []byte {
+	switch n.nType {
+	case static, root:
+		if len(path)-pos < len(n.path) || !strings.EqualFold(path[pos:pos+len(n.path)], n.path) {
+			return nil
+		}
+		return n.matchChildrenCaseInsensitive(path, pos+len(n.path), append(ciPath, n.path...))
 
-				// add param value to case insensitive path
-				ciPath = append(ciPath, path[:k]...)
-
-				// we need to go deeper!
-				if k < len(path) {
-					if len(n.children) > 0 {
-						// continue with child node
-						n = n.children[0]
-						loNPath = strings.ToLower(n.path)
-						loPath = loPath[k:]
-						path = path[k:]
-						continue
-					}
+	case param:
+		segEnd := pos
+		for segEnd < len(path) && path[segEnd] != '/' {
+			segEnd++
+		}
 
-					// ... but we can't
-					if fixTrailingSlash && len(path) == k+1 {
-						return ciPath, true
-					}
-					return ciPath, false
+		// the case of a delimiter may differ, so try all ends
+		delimited := n.hasDelimiter()
+		for end := segEnd; end > pos; end-- {
+			if n.constraint != nil {
+				value := path[pos:end]
+				if unescaped, err := url.PathUnescape(value); err == nil {
+					value = unescaped
 				}
-
-				if n.handle != nil {
-					return ciPath, true
-				} else if fixTrailingSlash && len(n.children) == 1 {
-					// No handle found. Check if a handle for this path + a
-					// trailing slash exists
-					n = n.children[0]
-					if n.path == "/" && n.handle != nil {
-						return append(ciPath, '/'), true
-					}
+				if !n.constraint.match(value) {
+					continue
 				}
-				return ciPath, false
-
-			case catchAll:
-				return append(ciPath, path...), true
-
-			default:
-				panic("invalid node type")
 			}
-		} else {
-			// We should have reached the node containing the handle.
-			// Check if this node has a handle registered.
-			if n.handle != nil {
-				return ciPath, true
+			if out := n.matchChildrenCaseInsensitive(path, end, append(ciPath, path[pos:end]...)); out != nil {
+				return out
 			}
-
-			// No handle found.
-			// Try to fix the path by adding a trailing slash
-			if fixTrailingSlash {
-				for i := 0; i < len(n.indices); i++ {
-					if n.indices[i] == '/' {
-						n = n.children[i]
-						if (len(n.path) == 1 && n.handle != nil) ||
-							(n.nType == catchAll && n.children[0].handle != nil) {
-							return append(ciPath, '/'), true
-						}
-						return ciPath, false
-					}
-				}
+			if !delimited {
+				break
 			}
-			return ciPath, false
 		}
-	}
+		return nil
 
-	// Nothing found.
-	// Try to fix the path by adding / removing a trailing slash
-	if fixTrailingSlash {
-		if path == "/" {
-			return ciPath, true
+	case catchAll:
+		if n.handle == nil {
+			return nil
 		}
-		if len(loPath)+1 == len(loNPath) && loNPath[len(loPath)] == '/' &&
-			loPath[1:] == loNPath[1:len(loPath)] && n.handle != nil {
-			return append(ciPath, n.path...), true
+		return append(ciPath, path[pos:]...)
+
+	default:
+		panic("invalid node type")
+	}
+}
+
+// matchChildrenCaseInsensitive works like matchChildren for
+// matchCaseInsensitive.
+func (n *node) matchChildrenCaseInsensitive(path string, pos int, ciPath []byte) []byte {
+	if pos == len(path) && n.handle != nil {
+		return ciPath
+	}
+
+	// the case of the first byte may differ, so try all static children
+	for _, child := range n.children {
+		if out := child.matchCaseInsensitive(path, pos, ciPath); out != nil {
+			return out
 		}
 	}
-	return ciPath, false
+	return nil
 }
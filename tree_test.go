@@ -248,40 +248,208 @@ func testRoutes(t *testing.T, routes []testRoute) {
 func TestTreeWildcardConflict(t *testing.T) {
 	routes := []testRoute{
 		{"/cmd/:tool/:sub", false},
-		{"/cmd/vet", true},
+		{"/cmd/:command", true},
+		{"/cmd/:tool/:subcommand", true},
 		{"/src/*filepath", false},
 		{"/src/*filepathx", true},
-		{"/src/", true},
-		{"/src1/", false},
-		{"/src1/*filepath", true},
-		{"/src2*filepath", true},
+		{"/src/:file", false},
+		{"/src/:name", true},
 		{"/search/:query", false},
-		{"/search/invalid", true},
+		{"/search/:q/x", true},
 		{"/user_:name", false},
-		{"/user_x", true},
 		{"/user_:name", false},
+		{"/user_:id/x", true},
 		{"/id:id", false},
-		{"/id/:id", true},
+		{"/id:name", true},
 	}
 	testRoutes(t, routes)
 }
 
-func TestTreeChildConflict(t *testing.T) {
+func TestTreeStaticWildcardSiblings(t *testing.T) {
 	routes := []testRoute{
+		{"/cmd/:tool/:sub", false},
 		{"/cmd/vet", false},
-		{"/cmd/:tool/:sub", true},
+		{"/src/*filepath", false},
+		{"/src/", false},
 		{"/src/AUTHORS", false},
-		{"/src/*filepath", true},
+		{"/src/:file", false},
+		{"/search/:query", false},
+		{"/search/invalid", false},
+		{"/user_:name", false},
 		{"/user_x", false},
-		{"/user_:name", true},
+		{"/id:id", false},
 		{"/id/:id", false},
-		{"/id:id", true},
-		{"/:id", true},
-		{"/*filepath", true},
+		{"/:id", false},
+		{"/*filepath", false},
 	}
 	testRoutes(t, routes)
 }
 
+func TestTreeStaticParamPriority(t *testing.T) {
+	tree := &node{}
+
+	routes := [...]string{
+		"/devices/new",
+		"/devices/:id",
+		"/devices/:id/state",
+		"/devices/*rest",
+		"/devices/new/state/current",
+		"/users/:id/edit",
+		"/users/me/:tab",
+		"/static/:file",
+		"/static/*filepath",
+		"/",
+		"/*filepath",
+	}
+	for _, route := range routes {
+		tree.addRoute(route, fakeHandler(route))
+	}
+
+	//printChildren(tree, "")
+
+	checkRequests(t, tree, testRequests{
+		{"/devices/new", false, "/devices/new", nil},
+		{"/devices/42", false, "/devices/:id", Params{Param{"id", "42"}}},
+		{"/devices/new/state", false, "/devices/:id/state", Params{Param{"id", "new"}}},
+		{"/devices/newer", false, "/devices/:id", Params{Param{"id", "newer"}}},
+		{"/devices/new/state/current", false, "/devices/new/state/current", nil},
+		{"/devices/new/state/other", false, "/devices/*rest", Params{Param{"rest", "/new/state/other"}}},
+		{"/devices/42/reboot", false, "/devices/*rest", Params{Param{"rest", "/42/reboot"}}},
+		{"/devices/", false, "/devices/*rest", Params{Param{"rest", "/"}}},
+		{"/users/me/edit", false, "/users/me/:tab", Params{Param{"tab", "edit"}}},
+		{"/users/42/edit", false, "/users/:id/edit", Params{Param{"id", "42"}}},
+		{"/users/me/profile", false, "/users/me/:tab", Params{Param{"tab", "profile"}}},
+		{"/static/app.js", false, "/static/:file", Params{Param{"file", "app.js"}}},
+		{"/static/js/app.js", false, "/static/*filepath", Params{Param{"filepath", "/js/app.js"}}},
+		{"/", false, "/", nil},
+		{"/favicon.ico", false, "/*filepath", Params{Param{"filepath", "/favicon.ico"}}},
+		{"/users/me", false, "/*filepath", Params{Param{"filepath", "/users/me"}}},
+	})
+
+	checkPriorities(t, tree)
+	checkMaxParams(t, tree)
+}
+
+func TestTreeSubSegmentParams(t *testing.T) {
+	tree := &node{}
+
+	routes := [...]string{
+		"/exports/:id.:format",
+		"/files/:name",
+		"/files/:name.:ext",
+		"/v:version/status",
+		"/v:version/users/:id",
+		"/range/:from-:to",
+		"/img/:w<int>x:h<int>",
+		"/dl/:file<[^/]+>.tar.gz",
+		"/src/:file.go",
+	}
+	for _, route := range routes {
+		tree.addRoute(route, fakeHandler(route))
+	}
+
+	//printChildren(tree, "")
+
+	checkRequests(t, tree, testRequests{
+		{"/exports/42.csv", false, "/exports/:id.:format", Params{Param{"id", "42"}, Param{"format", "csv"}}},
+		{"/exports/a.b.csv", false, "/exports/:id.:format", Params{Param{"id", "a.b"}, Param{"format", "csv"}}},
+		{"/exports/42", true, "", Params{Param{"id", "42"}}},
+		{"/exports/42.", true, "", Params{Param{"id", "42"}}},
+		{"/files/README", false, "/files/:name", Params{Param{"name", "README"}}},
+		{"/files/archive.tar.gz", false, "/files/:name", Params{Param{"name", "archive.tar.gz"}}},
+		{"/v2/status", false, "/v:version/status", Params{Param{"version", "2"}}},
+		{"/v2/users/7", false, "/v:version/users/:id", Params{Param{"version", "2"}, Param{"id", "7"}}},
+		{"/range/10-20", false, "/range/:from-:to", Params{Param{"from", "10"}, Param{"to", "20"}}},
+		{"/img/640x480", false, "/img/:w<int>x:h<int>", Params{Param{"w", "640"}, Param{"h", "480"}}},
+		{"/img/640xabc", true, "", Params{Param{"w", "640"}}},
+		{"/dl/go1.10.tar.gz", false, "/dl/:file<[^/]+>.tar.gz", Params{Param{"file", "go1.10"}}},
+		{"/src/main", false, "/src/:file.go", Params{Param{"file.go", "main"}}},
+	})
+
+	checkPriorities(t, tree)
+	checkMaxParams(t, tree)
+
+	if _, _, tsr := tree.getValue("/exports/42.csv/"); !tsr {
+		t.Error("no trailing slash redirect for '/exports/42.csv/'")
+	}
+	if _, _, tsr := tree.getValue("/v2/status/"); !tsr {
+		t.Error("no trailing slash redirect for '/v2/status/'")
+	}
+
+	for path, want := range map[string]string{
+		"/EXPORTS/42.CSV":  "/exports/42.CSV",
+		"/V2/STATUS":       "/v2/status",
+		"/DL/Go.TAR.GZ":    "/dl/Go.tar.gz",
+		"/Range/1-2/":      "/range/1-2",
+		"/IMG/640X480":     "/img/640x480",
+		"/v2/users/Gopher": "/v2/users/Gopher",
+	} {
+		if out, found := tree.findCaseInsensitivePath(path, true); !found || string(out) != want {
+			t.Errorf("findCaseInsensitivePath(%q): got %q %v, want %q", path, out, found, want)
+		}
+	}
+}
+
+func TestTreeWithout(t *testing.T) {
+	tree := &node{}
+	routes := [...]string{
+		"/",
+		"/cmd/:tool/:sub",
+		"/cmd/:tool/",
+		"/src/*filepath",
+		"/search/",
+		"/search/:query",
+		"/user_:name",
+		"/user_:name/about",
+	}
+	for _, route := range routes {
+		tree.addRoute(route, fakeHandler(route))
+	}
+	shared := tree.copy()
+
+	tree = tree.without("/cmd/:tool/")
+	tree = tree.without("/user_:name")
+	if tree.without("/missing") == nil {
+		t.Fatal("tree emptied by removing a missing route")
+	}
+
+	checkRequests(t, tree, testRequests{
+		{"/", false, "/", nil},
+		{"/cmd/test/", true, "", Params{Param{"tool", "test"}}},
+		{"/cmd/test/3", false, "/cmd/:tool/:sub", Params{Param{"tool", "test"}, Param{"sub", "3"}}},
+		{"/src/some/file.png", false, "/src/*filepath", Params{Param{"filepath", "/some/file.png"}}},
+		{"/search/gopher", false, "/search/:query", Params{Param{"query", "gopher"}}},
+		{"/user_gopher", true, "", Params{Param{"name", "gopher"}}},
+		{"/user_gopher/about", false, "/user_:name/about", Params{Param{"name", "gopher"}}},
+	})
+	checkPriorities(t, tree)
+	checkMaxParams(t, tree)
+
+	// the original tree is not changed
+	checkRequests(t, shared, testRequests{
+		{"/cmd/test/", false, "/cmd/:tool/", Params{Param{"tool", "test"}}},
+		{"/user_gopher", false, "/user_:name", Params{Param{"name", "gopher"}}},
+	})
+
+	if (&node{path: "/", handle: fakeHandler("/")}).without("/") != nil {
+		t.Error("tree without its only route is not empty")
+	}
+}
+
+func TestTreeLookupAllocs(t *testing.T) {
+	tree := &node{}
+	for _, route := range [...]string{"/", "/devices/new", "/devices/:id", "/devices/*rest"} {
+		tree.addRoute(route, fakeHandler(route))
+	}
+
+	for path, want := range map[string]float64{"/": 0, "/devices/new": 0, "/devices/42": 1, "/devices/42/x": 1} {
+		allocs := testing.AllocsPerRun(100, func() { tree.getValue(path) })
+		if allocs != want {
+			t.Errorf("getValue(%q): %v allocs, want %v", path, allocs, want)
+		}
+	}
+}
+
 func TestTreeDupliatePath(t *testing.T) {
 	tree := &node{}
 
@@ -351,13 +519,14 @@ func TestTreeCatchAllConflict(t *testing.T) {
 func TestTreeCatchAllConflictRoot(t *testing.T) {
 	routes := []testRoute{
 		{"/", false},
-		{"/*filepath", true},
+		{"/*filepath", false},
+		{"/*other", true},
 	}
 	testRoutes(t, routes)
 }
 
 func TestTreeDoubleWildcard(t *testing.T) {
-	const panicMsg = "only one wildcard per path segment is allowed"
+	const panicMsg = "wildcards in a path segment must be separated by a static delimiter"
 
 	routes := [...]string{
 		"/:foo:bar",
@@ -678,11 +847,10 @@ func TestTreeWildcardConflictEx(t *testing.T) {
 		existPath    string
 		existSegPath string
 	}{
-		{"/who/are/foo", "/foo", `/who/are/\*you`, `/\*you`},
-		{"/who/are/foo/", "/foo/", `/who/are/\*you`, `/\*you`},
-		{"/who/are/foo/bar", "/foo/bar", `/who/are/\*you`, `/\*you`},
-		{"/conxxx", "xxx", `/con:tact`, `:tact`},
-		{"/conooo/xxx", "ooo", `/con:tact`, `:tact`},
+		{"/who/are/*me", `\*me`, `/who/are/\*you`, `\*you`},
+		{"/who/are/*youx", `\*youx`, `/who/are/\*you`, `\*you`},
+		{"/con:other", ":other", `/con:tact`, `:tact`},
+		{"/con:other/xxx", ":other", `/con:tact`, `:tact`},
 	}
 
 	for _, conflict := range conflicts {
@@ -709,3 +877,14 @@ func TestTreeWildcardConflictEx(t *testing.T) {
 		}
 	}
 }
+
+func TestTreeSplitKeepsRoute(t *testing.T) {
+	tree := &node{}
+	tree.addRoute("/any", fakeHandler("/any")).route = &Route{Path: "/any", AuthMethods: []string{"bearer"}}
+	tree.addRoute("/other", fakeHandler("/other")).route = &Route{Path: "/other"}
+
+	leaf, _, _ := tree.getLeaf("/any")
+	if leaf == nil || leaf.route == nil || leaf.route.Path != "/any" {
+		t.Fatalf("route lost after splitting its node: %+v", leaf)
+	}
+}
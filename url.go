@@ -0,0 +1,90 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Name names a route, so its URL can be built with Router.URL.
+// Names must be unique within a router.
+func Name(name string) RouteOption {
+	return func(route *Route) {
+		route.Name = name
+	}
+}
+
+// URL builds the path of the route with the given name. pairs are parameter
+// names and values in turn, e.g.
+//     router.URL("device", "id", "42", "rest", "a/b")
+// Values of ":param" segments are escaped completely, values of "*catchAll"
+// segments keep their slashes. Missing, extra and empty parameters and
+// values violating a constraint are errors.
+func (r *Router) URL(name string, pairs ...string) (string, error) {
+	route, ok := r.loadTable().names[name]
+	if !ok {
+		return "", errors.New("no route named '" + name + "'")
+	}
+	if len(pairs)%2 != 0 {
+		return "", errors.New("odd number of parameter names and values for route '" + name + "'")
+	}
+	values := make(map[string]string, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		values[pairs[i]] = pairs[i+1]
+	}
+
+	path := route.Path
+	var buf strings.Builder
+	for {
+		i := strings.IndexAny(path, ":*")
+		if i < 0 {
+			buf.WriteString(path)
+			break
+		}
+		end := i + wildcardEnd(path[i:])
+		wildcard := path[i]
+		key, constraint := splitWildcard(path[i+1 : end])
+		value, ok := values[key]
+		if !ok || value == "" {
+			return "", errors.New("missing parameter '" + key + "' for route '" + name + "'")
+		}
+		if constraint != "" && !parseConstraint(constraint).match(value) {
+			return "", errors.New("parameter '" + key + "' does not match constraint '<" + constraint + ">' of route '" + name + "'")
+		}
+		delete(values, key)
+
+		buf.WriteString(path[:i])
+		if wildcard == ':' {
+			buf.WriteString(url.PathEscape(value))
+		} else {
+			// the catch-all value includes the slash in front of it
+			segments := strings.Split(strings.TrimPrefix(value, "/"), "/")
+			for j, segment := range segments {
+				segments[j] = url.PathEscape(segment)
+			}
+			buf.WriteString(strings.Join(segments, "/"))
+		}
+		path = path[end:]
+	}
+
+	for key := range values {
+		return "", errors.New("unknown parameter '" + key + "' for route '" + name + "'")
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwt_http_router
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRouterURL(t *testing.T) {
+	router := New(JwtConfig{})
+	handle := func(_ http.ResponseWriter, _ *http.Request, _ Params, _ Jwt) {}
+	router.GET("/devices", handle, Name("devices"))
+	router.GET("/devices/:id/services/*rest", handle, Name("service"))
+	router.GET("/users/:name", handle, Name("user"))
+	router.GET("/exports/:id.:format", handle, Name("export"))
+
+	tests := []struct {
+		name  string
+		pairs []string
+		url   string
+	}{
+		{"devices", nil, "/devices"},
+		{"service", []string{"id", "42", "rest", "/a b/c"}, "/devices/42/services/a%20b/c"},
+		{"service", []string{"rest", "x", "id", "a/b"}, "/devices/a%2Fb/services/x"},
+		{"user", []string{"name", "jane doe?"}, "/users/jane%20doe%3F"},
+		{"export", []string{"id", "42", "format", "csv"}, "/exports/42.csv"},
+	}
+	for _, test := range tests {
+		url, err := router.URL(test.name, test.pairs...)
+		if err != nil || url != test.url {
+			t.Errorf("%s %v: got %q %v, want %q", test.name, test.pairs, url, err, test.url)
+		}
+	}
+
+	for _, invalid := range [][]string{
+		{"unknown"},
+		{"user"},
+		{"user", "name"},
+		{"user", "name", ""},
+		{"user", "name", "jane", "id", "1"},
+	} {
+		if url, err := router.URL(invalid[0], invalid[1:]...); err == nil {
+			t.Errorf("%v: got %q, want error", invalid, url)
+		}
+	}
+
+	if recv := catchPanic(func() { router.GET("/other", handle, Name("user")) }); recv == nil {
+		t.Error("duplicate route name did not panic")
+	}
+}